@@ -0,0 +1,111 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	visibleHost string
+	// rDNS naming typical of consumer ISPs, or an address embedded in the name
+	residentialHost = regexp.MustCompile(`(?i)(^|[.-])(dsl|adsl|vdsl|cable|dyn|dynamic|dhcp|pool|ppp|pppoe|dial|dialup|res|resi|residential|broadband|bb|cust|customer|client|home|user|fibre|fiber|ftth|mobile|lte|3g|4g|5g|wireless|wifi)[0-9]*([.-]|$)|\d{1,3}[.-]\d{1,3}[.-]\d{1,3}[.-]\d{1,3}`)
+)
+
+// the server tells us our visible host in a few places, check it every time it changes
+func CheckHost(m *Msg) {
+	var host string
+	switch {
+	case m.cmd == "396": // RPL_HOSTHIDDEN
+		host, _ = split(m.args, " ")
+	case m.cmd == "311" && strings.EqualFold(m.rcpt, myNick): // RPL_WHOISUSER
+		args := strings.Fields(m.args)
+		if len(args) > 2 && strings.EqualFold(args[0], myNick) {
+			host = args[2]
+		}
+	case m.cmd == "JOIN" && strings.EqualFold(m.nick, myNick):
+		host = m.host
+	}
+	if len(host) < 1 || host == visibleHost {
+		return
+	}
+	visibleHost = host
+	if unknownAddr(host) && len(*exitIps) < 1 {
+		// tor exits often have no rDNS, only -exit-ip makes this a leak
+		PrintLine("Cloak: visible host is an uncloaked address " + ansiColour("Yellow", host) + ", check it belongs to your proxy")
+		return
+	}
+	if problem := hostProblem(host); len(problem) > 0 {
+		PrintLine(ansiColour("Red", "!!! LEAK: visible host '"+host+"' "+problem+" !!!"))
+		if *leakQuit {
+			PrintLine(ansiColour("Red", "!!! LEAK: disconnecting !!!"))
+			conn.Close()
+		}
+	} else {
+		PrintLine("Cloak: visible host is " + ansiColour("Green", host))
+	}
+}
+
+// the proxy's own address (e.g. an ssh -D box) or what -exit-ip lists
+func expectedAddr(ip net.IP) bool {
+	if h, _, e := net.SplitHostPort(*ircProxy); e == nil {
+		if proxy := net.ParseIP(h); proxy != nil && proxy.Equal(ip) {
+			return true
+		}
+	}
+	for _, exit := range strings.Split(*exitIps, ",") {
+		exit = strings.TrimSpace(exit)
+		if _, n, e := net.ParseCIDR(exit); e == nil && n.Contains(ip) {
+			return true
+		}
+		if e := net.ParseIP(exit); e != nil && e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// a bare address that isn't loopback, the proxy's or an -exit-ip
+func unknownAddr(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsLoopback() && !expectedAddr(ip) && len(*ircCloak) < 1
+}
+
+func hostProblem(host string) string {
+	if len(*ircCloak) > 0 {
+		if ok, _ := path.Match(strings.ToLower(*ircCloak), strings.ToLower(host)); !ok {
+			return "does not match expected cloak '" + *ircCloak + "'"
+		}
+		return ""
+	}
+	if unknownAddr(host) {
+		return "is an uncloaked address that isn't the proxy's or an -exit-ip"
+	} else if net.ParseIP(host) != nil {
+		return ""
+	}
+	lower := strings.ToLower(host)
+	if strings.Contains(lower, "tor") && strings.Contains(lower, "exit") {
+		return ""
+	}
+	if residentialHost.MatchString(host) {
+		return "looks like a residential connection, is the proxy working?"
+	}
+	return ""
+}
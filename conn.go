@@ -17,9 +17,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -39,28 +45,125 @@ var saneCipherSuites = []uint16{ // Fuck RC4 and DES && prefer ephemeral KEX.
 	tls.TLS_RSA_WITH_AES_256_CBC_SHA,    // no pfs!
 }
 
-func socksConn(host, socksproxy string) (net.Conn, error) {
+type Endpoint struct {
+	host    string
+	tls     bool
+	pin     []byte
+	timeout time.Duration
+}
+
+func (ep *Endpoint) String() string {
+	s := ep.host
+	if ep.tls {
+		s += " (tls)"
+	} else {
+		s += " (plain)"
+	}
+	return s
+}
+
+// host:port[;tls|plain][;pin=<sha256 hex>][;timeout=<duration>], comma separated
+// named after the first endpoint, whichever one we end up connected to
+var ircNetwork string
+
+func (ep *Endpoint) Network() string {
+	host, _, e := net.SplitHostPort(ep.host)
+	if e != nil {
+		return ep.host
+	}
+	return host
+}
+
+func ParseEndpoints(list string, ssl bool, timeout time.Duration) ([]*Endpoint, error) {
+	var eps []*Endpoint
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) < 1 {
+			continue
+		}
+		opts := strings.Split(spec, ";")
+		ep := &Endpoint{host: opts[0], tls: ssl, timeout: timeout}
+		if _, port := split(ep.host, ":"); len(port) < 1 {
+			return nil, errors.New("endpoint '" + ep.host + "' must be host:port")
+		}
+		for _, opt := range opts[1:] {
+			k, v := split(opt, "=")
+			switch k {
+			case "tls":
+				ep.tls = true
+			case "plain":
+				ep.tls = false
+			case "pin":
+				pin, e := hex.DecodeString(strings.Replace(v, ":", "", -1))
+				if e != nil || len(pin) != sha256.Size {
+					return nil, errors.New("endpoint '" + ep.host + "' has a bad pin")
+				}
+				ep.pin = pin
+				ep.tls = true
+			case "timeout":
+				d, e := time.ParseDuration(v)
+				if e != nil {
+					return nil, e
+				}
+				ep.timeout = d
+			default:
+				return nil, errors.New("endpoint '" + ep.host + "' has unknown option '" + k + "'")
+			}
+		}
+		eps = append(eps, ep)
+	}
+	if len(eps) < 1 {
+		return nil, errors.New("no endpoints given")
+	}
+	return eps, nil
+}
+
+func shuffleEndpoints(eps []*Endpoint) {
+	for i := len(eps) - 1; i > 0; i-- {
+		j := properRand(i + 1)
+		eps[i], eps[j] = eps[j], eps[i]
+	}
+}
+
+func socksConn(ctx context.Context, host, socksproxy string) (net.Conn, error) {
 	s := fmt.Sprintf("%d", time.Now().UnixNano()) // hacky isolation "good enough"
 	d, e := proxy.SOCKS5("tcp", socksproxy, &proxy.Auth{User: s, Password: s}, new(net.Dialer))
 	if e != nil {
 		return nil, e
 	}
-	conn, e := d.Dial("tcp", host)
+	conn, e := d.(proxy.ContextDialer).DialContext(ctx, "tcp", host)
 	if e != nil {
 		return nil, e
 	}
 	return conn, nil
 }
 
-func tlsConn(hostname string, conn net.Conn) *tls.Conn {
+// sha256 of the server's certificate, for /leek-verify tls
+var tlsLeaf []byte
+
+func tlsConn(hostname string, pin []byte, conn net.Conn) (*tls.Conn, error) {
 	cfg := new(tls.Config)
 	cfg.ServerName = hostname
 	cfg.CipherSuites = saneCipherSuites
+	if pin != nil {
+		// the pin is the trust anchor, e.g. self-signed certs on onions
+		cfg.InsecureSkipVerify = true
+	}
 	tconn := tls.Client(conn, cfg)
 	if e := tconn.Handshake(); e != nil {
-		return tconn
+		return nil, e
 	}
 	state := tconn.ConnectionState()
+	if len(state.PeerCertificates) < 1 {
+		tconn.Close()
+		return nil, errors.New("TLS: " + hostname + " sent no certificate")
+	}
+	leaf := sha256.Sum256(state.PeerCertificates[0].Raw)
+	if pin != nil {
+		if !bytes.Equal(leaf[:], pin) {
+			return nil, errors.New("TLS: certificate for " + hostname + " does not match pin " + fingerprint(leaf[:], true))
+		}
+	}
 	PrintLine("TLS: Cipher '" + ansiColour("Green", tlsCipherSuite(state.CipherSuite)) + "'")
 	for k, v := range state.PeerCertificates {
 		certLine := fmt.Sprintf("TLS: Cert Chain [%d]\tSubject: %s\tIssuer: %s\tFingerprint: %s",
@@ -69,10 +172,12 @@ func tlsConn(hostname string, conn net.Conn) *tls.Conn {
 			ansiColour("White", v.Issuer.CommonName),
 			ansiColour("White", fingerprint(v.Raw, false)))
 		PrintLine(certLine)
+		if k == 0 {
+			PrintArt("TLS: ", fingerprintArt(v.Raw, false, "TLS"))
+		}
 	}
-	return tconn
+	return tconn, nil
 }
-
 func tlsCipherSuite(c uint16) string {
 	cipherSuites := map[uint16]string{
 		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
@@ -94,14 +199,48 @@ func tlsCipherSuite(c uint16) string {
 	}
 }
 
-func Connect(host, proxy string, ssl bool) (net.Conn, error) {
-	c, e := socksConn(host, proxy)
+func dialEndpoint(ep *Endpoint, proxy string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ep.timeout)
+	defer cancel()
+	c, e := socksConn(ctx, ep.host, proxy)
 	if e != nil {
 		return nil, e
 	}
-	if ssl {
-		name, _ := split(host, ":")
-		c = tlsConn(name, c)
+	if ep.tls {
+		c.SetDeadline(time.Now().Add(ep.timeout))
+		name, _ := split(ep.host, ":")
+		tc, e := tlsConn(name, ep.pin, c)
+		if e != nil {
+			c.Close()
+			return nil, e
+		}
+		tc.SetDeadline(time.Time{})
+		c = tc
 	}
 	return c, nil
 }
+
+func Connect(eps []*Endpoint, proxy string, shuffle bool) (net.Conn, *Endpoint, error) {
+	if shuffle {
+		shuffleEndpoints(eps)
+	}
+	var e error
+	for _, ep := range eps {
+		PrintLine("Connecting to " + ep.String() + "...")
+		var c net.Conn
+		c, e = dialEndpoint(ep, proxy)
+		if e != nil {
+			PrintError(e)
+			continue
+		}
+		// only the certificate of the connection we keep is read aloud with /leek-verify tls
+		tlsLeaf = nil
+		if tc, ok := c.(*tls.Conn); ok {
+			leaf := sha256.Sum256(tc.ConnectionState().PeerCertificates[0].Raw)
+			tlsLeaf = leaf[:]
+		}
+		PrintLine("Connected to " + ansiColour("Green", ep.String()))
+		return c, ep, nil
+	}
+	return nil, nil, errors.New("all endpoints failed, last error: " + e.Error())
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// what the rest of the client needs from an end-to-end protocol. OTR is the
+// only one for now, anything newer (OTRv4, a double ratchet) goes in
+// backends and can then be picked per contact with /e2e. sessions, files,
+// channel keys, leekspeak and the prompt only talk to this; SMP, policies and
+// the contact store (trust, secrets, the /e2e choices themselves) are OTR's and
+// a new backend has to share them or bring its own
+type Backend interface {
+	Name() string
+	Start(rcpt string)
+	End(rcpt string)
+	EndAll()
+	Send(rcpt, msg string)
+	Recv(m *Msg)          // decrypts in place, sets m.enc
+	Nick(from, to string) // move any session along with a nick change
+	IsEncrypted(rcpt string) bool
+	Fingerprint(rcpt string) []byte // nil unless encrypted
+	Trust(rcpt string) Trust
+	Pending(rcpt string) int
+	Status(rcpt string)
+	Control(rcpt string, args ...string) bool // a \x01 line only the other client sees, false if not encrypted
+}
+
+var (
+	backends   = map[string]Backend{"otr": otrBackend{}}
+	e2eDefault Backend
+)
+
+func e2eBackend(name string) (Backend, error) {
+	if b, ok := backends[strings.ToLower(name)]; ok {
+		return b, nil
+	}
+	var names []string
+	for n := range backends {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, errors.New("no backend " + name + ", have: " + strings.Join(names, ", "))
+}
+
+// the backend rcpt's messages go through, the default unless set with /e2e
+func backendFor(rcpt string) Backend {
+	if OTR != nil {
+		if name, ok := OTR.Backend[contactKey(rcpt)]; ok {
+			if b, ok := backends[name]; ok {
+				return b
+			}
+		}
+	}
+	return e2eDefault
+}
+
+func E2eNick(from, to string) {
+	for _, b := range backends {
+		b.Nick(from, to)
+	}
+}
+
+func E2eEndAll() {
+	for _, b := range backends {
+		b.EndAll()
+	}
+}
+
+func E2eSetBackend(rcpt, name string) {
+	if len(name) < 1 {
+		PrintLine("E2E: " + rcpt + " uses " + backendFor(rcpt).Name())
+		return
+	}
+	if name == "default" {
+		delete(OTR.Backend, contactKey(rcpt))
+		PrintLine("E2E: " + rcpt + " is back to the default " + e2eDefault.Name())
+		return
+	}
+	b, e := e2eBackend(name)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	if old := backendFor(rcpt); old != b && old.IsEncrypted(rcpt) {
+		old.End(rcpt)
+		PrintLine("E2E: Ended the " + old.Name() + " session with " + rcpt)
+	}
+	OTR.Backend[contactKey(rcpt)] = b.Name()
+	PrintLine("E2E: " + rcpt + " now uses " + b.Name())
+}
+
+func E2eBackends() {
+	PrintLine("E2E: Default backend is " + e2eDefault.Name())
+	var keys []string
+	for k := range OTR.Backend {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		PrintLine("E2E: " + k + " uses " + OTR.Backend[k])
+	}
+}
+
+// the x/crypto/otr code as a Backend
+type otrBackend struct{}
+
+func (otrBackend) Name() string                   { return "otr" }
+func (otrBackend) Start(rcpt string)              { OtrStart(rcpt) }
+func (otrBackend) End(rcpt string)                { OtrEnd(rcpt) }
+func (otrBackend) EndAll()                        { otrEndAll() }
+func (otrBackend) Send(rcpt, msg string)          { OtrSend(rcpt, msg) }
+func (otrBackend) Recv(m *Msg)                    { OtrRecv(m) }
+func (otrBackend) Nick(from, to string)           { OtrNick(from, to) }
+func (otrBackend) IsEncrypted(rcpt string) bool   { return OtrIsEncrypted(rcpt) }
+func (otrBackend) Fingerprint(rcpt string) []byte { return theirFingerprint(rcpt) }
+func (otrBackend) Trust(rcpt string) Trust        { return OtrTrust(rcpt) }
+func (otrBackend) Pending(rcpt string) int        { return OtrPending(rcpt) }
+func (otrBackend) Status(rcpt string)             { OtrStatus(rcpt) }
+func (otrBackend) Control(rcpt string, args ...string) bool {
+	return otrControl(rcpt, args...)
+}
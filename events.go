@@ -0,0 +1,330 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// security events go to their own journal next to the contact store, one
+// record per line and only ever appended to. with the store encrypted each
+// line is secretbox(json) under a key from the vault passphrase and a salt
+// written once to the file; without it the lines are plain json. each record
+// carries its number and the sha256 of the line before it, so lines taken out
+// or reordered show up when read back (sealed ones can't be forged either).
+type otrEvent struct {
+	Seq         uint64 `json:",omitempty"` // from 1, 0 for records older than the chain
+	Prev        string `json:",omitempty"` // hex sha256 of the previous line as written
+	Time        time.Time
+	Nick        string // contactKey()
+	Fingerprint string `json:",omitempty"` // hex
+	Kind        string
+	Detail      string `json:",omitempty"`
+}
+
+const evSaltLine = "#salt "
+
+var (
+	evFile   string
+	evKey    *[32]byte
+	evSalt   []byte
+	evQueued []otrEvent // logged while locked, written on unlock
+	evSeq    uint64     // of the last record written
+	evPrev   string     // and the hash of its line
+	evTailed bool       // the two above have been read from the file
+)
+
+func evLineHash(line []byte) string {
+	h := sha256.Sum256(line)
+	return hex.EncodeToString(h[:])
+}
+
+// where the chain left off, records are counted whether they can be read or not
+func evTail() error {
+	f, e := os.Open(evFile)
+	if os.IsNotExist(e) {
+		evTailed = true
+		return nil
+	} else if e != nil {
+		return e
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) < 1 || strings.HasPrefix(string(line), evSaltLine) {
+			continue
+		}
+		evSeq++
+		evPrev = evLineHash(line)
+	}
+	if e := sc.Err(); e != nil {
+		return e
+	}
+	evTailed = true
+	return nil
+}
+
+func (ev *otrEvent) String() string {
+	who := ev.Nick
+	if OTR.HashKey != nil && len(who) > 8 {
+		who = "#" + who[:8]
+	}
+	s := "[" + ev.Time.Local().Format("2006-01-02 15:04") + "] " + who + " " + ansiColour(evColour(ev.Kind), ev.Kind)
+	if len(ev.Detail) > 0 {
+		s += " " + ev.Detail
+	}
+	if len(ev.Fingerprint) > 8 {
+		s += " (" + ev.Fingerprint[:8] + ")"
+	}
+	return s
+}
+
+func evColour(kind string) string {
+	switch kind {
+	case "key-changed", "key-revoked", "smp-failed", "refused", "ake-failed":
+		return "Red"
+	case "smp-ok", "trusted", "key-accepted":
+		return "Green"
+	}
+	return "Yellow"
+}
+
+func otrLog(nick, kind, detail string) {
+	if !*otrEvents {
+		return
+	}
+	ev := otrEvent{Time: time.Now().UTC(), Nick: contactKey(nick), Kind: kind, Detail: detail}
+	fp := theirFingerprint(nick)
+	if fp == nil && !otrLocked {
+		if c := contactByNick(nick); c != nil {
+			fp = c.Fingerprint
+		}
+	}
+	if fp != nil {
+		ev.Fingerprint = hex.EncodeToString(fp)
+	}
+	evQueued = append(evQueued, ev)
+	if e := evFlush(); e != nil {
+		PrintError(e)
+	}
+}
+
+// salt from the file if it has one, else a new one written ahead of the first sealed line
+func evReadSalt() ([]byte, bool, error) {
+	f, e := os.Open(evFile)
+	if os.IsNotExist(e) {
+		return nil, false, nil
+	} else if e != nil {
+		return nil, false, e
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), evSaltLine) {
+			salt, e := hex.DecodeString(strings.TrimPrefix(sc.Text(), evSaltLine))
+			return salt, true, e
+		}
+	}
+	return nil, false, sc.Err()
+}
+
+func evLoadKey() (bool, error) {
+	if evKey != nil {
+		return false, nil
+	}
+	salt, found, e := evReadSalt()
+	if e != nil {
+		return false, e
+	}
+	if !found {
+		salt = make([]byte, vaultSaltSize)
+		if _, e := io.ReadFull(rand.Reader, salt); e != nil {
+			return false, e
+		}
+	}
+	evSalt = salt
+	evKey, e = vaultKey(storePass, salt)
+	return !found, e
+}
+
+func evFlush() error {
+	sealed := storePass != nil
+	if otrLocked || len(evQueued) < 1 || (*otrEncrypt && !sealed) {
+		return nil // wait for the passphrase
+	}
+	if !evTailed {
+		if e := evTail(); e != nil {
+			return e
+		}
+	}
+	var out []byte
+	seq, prev := evSeq, evPrev
+	if sealed {
+		fresh, e := evLoadKey()
+		if e != nil {
+			return e
+		}
+		if fresh {
+			out = append(out, evSaltLine+hex.EncodeToString(evSalt)+"\n"...)
+		}
+	}
+	for _, ev := range evQueued {
+		seq++
+		ev.Seq, ev.Prev = seq, prev
+		line, e := json.Marshal(ev)
+		if e != nil {
+			return e
+		}
+		if sealed {
+			var nonce [vaultNonceSize]byte
+			if _, e := io.ReadFull(rand.Reader, nonce[:]); e != nil {
+				return e
+			}
+			box := secretbox.Seal(nonce[:], line, &nonce, evKey)
+			line = []byte(base64.StdEncoding.EncodeToString(box))
+		}
+		prev = evLineHash(line)
+		out = append(append(out, line...), '\n')
+	}
+	f, e := os.OpenFile(evFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	if _, e := f.Write(out); e != nil {
+		return e
+	}
+	evQueued = nil
+	evSeq, evPrev = seq, prev
+	return nil
+}
+
+// on /otr-lock, the derived key goes with the passphrase
+func evLock() {
+	if evKey != nil {
+		wipe(evKey[:])
+		evKey = nil
+	}
+}
+
+// with the number of records that can't be read and that break the chain
+func evRead() (evs []otrEvent, bad, broken int, err error) {
+	f, e := os.Open(evFile)
+	if os.IsNotExist(e) {
+		return evQueued, 0, 0, nil
+	} else if e != nil {
+		return nil, 0, 0, e
+	}
+	defer f.Close()
+	var seq uint64
+	prev := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) < 1 || strings.HasPrefix(string(line), evSaltLine) {
+			continue
+		}
+		seq++
+		hash := evLineHash(line)
+		want := prev
+		prev = hash
+		if line[0] != '{' {
+			if storePass == nil {
+				return nil, 0, 0, errors.New("OTR: event journal is encrypted, /otr-unlock first")
+			}
+			if _, e := evLoadKey(); e != nil {
+				return nil, 0, 0, e
+			}
+			box, e := base64.StdEncoding.DecodeString(string(line))
+			if e != nil || len(box) < vaultNonceSize+secretbox.Overhead {
+				bad++
+				continue
+			}
+			var nonce [vaultNonceSize]byte
+			copy(nonce[:], box)
+			var ok bool
+			if line, ok = secretbox.Open(nil, box[vaultNonceSize:], &nonce, evKey); !ok {
+				bad++
+				continue
+			}
+		}
+		var ev otrEvent
+		if json.Unmarshal(line, &ev) != nil {
+			bad++
+			continue
+		}
+		if ev.Seq != 0 && (ev.Seq != seq || ev.Prev != want) {
+			broken++
+		}
+		evs = append(evs, ev)
+	}
+	return append(evs, evQueued...), bad, broken, sc.Err()
+}
+
+// who is a nick, a hex fingerprint or empty for everyone
+func OtrEvents(who string, n int) {
+	evs, bad, broken, e := evRead()
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	if bad > 0 {
+		PrintLine("OTR: " + ansiColour("Red", strconv.Itoa(bad)+" unreadable record(s)") + " in " + evFile)
+	}
+	if broken > 0 {
+		PrintLine("OTR: " + ansiColour("Red", strconv.Itoa(broken)+" record(s) out of sequence") + " in " + evFile + ", lines were removed or moved")
+	}
+	fps := make(map[string]bool)
+	if len(who) > 0 {
+		fps[strings.ToLower(strings.Replace(who, ":", "", -1))] = true
+		if !otrLocked {
+			if c := contactByNick(who); c != nil {
+				fps[hex.EncodeToString(c.Fingerprint)] = true
+			}
+		}
+	}
+	var shown []otrEvent
+	for _, ev := range evs {
+		if len(who) < 1 || ev.Nick == contactKey(who) || fps[ev.Fingerprint] {
+			shown = append(shown, ev)
+		}
+	}
+	if len(shown) > n {
+		PrintLine("OTR: " + strconv.Itoa(len(shown)-n) + " older event(s) not shown")
+		shown = shown[len(shown)-n:]
+	}
+	for _, ev := range shown {
+		PrintLine("OTR: " + ev.String())
+	}
+	if len(shown) < 1 {
+		PrintLine("OTR: No security events recorded")
+	}
+}
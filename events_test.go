@@ -0,0 +1,102 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func testJournal(t *testing.T, sealed bool) {
+	testStore(t, sealed, false)
+	if sealed {
+		storePass = []byte("correct horse")
+	}
+	*otrEvents = true
+	evFile = otrFile + ".events"
+	evKey, evSalt, evQueued, evSeq, evPrev, evTailed = nil, nil, nil, 0, "", false
+	t.Cleanup(func() { evKey, evSalt, evQueued, evSeq, evPrev, evTailed = nil, nil, nil, 0, "", false })
+	for _, kind := range []string{"new-key", "smp-ok", "key-changed", "key-accepted"} {
+		otrLog("alice", kind, "")
+	}
+}
+
+func TestEventChain(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(recs [][]byte) [][]byte
+		bad, broken int // plaintext
+		sealedBad   int // a sealed record can't be edited, it stops opening instead
+	}{
+		{"valid", func(r [][]byte) [][]byte { return r }, 0, 0, 0},
+		{"tampered", func(r [][]byte) [][]byte {
+			r[1] = bytes.Replace(r[1], []byte("smp-ok"), []byte("trusted"), 1)
+			if r[1][0] != '{' {
+				r[1][len(r[1])/2] ^= 1
+			}
+			return r
+		}, 0, 1, 1},
+		{"dropped", func(r [][]byte) [][]byte { return append(r[:1], r[2:]...) }, 0, 2, 0},
+		{"reordered", func(r [][]byte) [][]byte { r[1], r[2] = r[2], r[1]; return r }, 0, 3, 0},
+	}
+	for _, sealed := range []bool{false, true} {
+		for _, tt := range tests {
+			testJournal(t, sealed)
+			d, _ := ioutil.ReadFile(evFile)
+			lines := bytes.Split(bytes.TrimSuffix(d, []byte("\n")), []byte("\n"))
+			var head [][]byte
+			if sealed {
+				head, lines = lines[:1], lines[1:] // the salt
+			}
+			if len(lines) != 4 {
+				t.Fatalf("sealed %v: %d records written, want 4", sealed, len(lines))
+			}
+			lines = append(head, tt.change(lines)...)
+			ioutil.WriteFile(evFile, append(bytes.Join(lines, []byte("\n")), '\n'), 0600)
+			evKey = nil
+			_, bad, broken, e := evRead()
+			wantBad := tt.bad
+			if sealed {
+				wantBad = tt.sealedBad
+			}
+			if e != nil || bad != wantBad || broken != tt.broken {
+				t.Errorf("%s, sealed %v: %d unreadable, %d out of sequence (%v), want %d, %d",
+					tt.name, sealed, bad, broken, e, wantBad, tt.broken)
+			}
+		}
+	}
+}
+
+// a reopened journal carries on the chain where the file left off
+func TestEventChainResumes(t *testing.T) {
+	testJournal(t, false)
+	evSeq, evPrev, evTailed = 0, "", false
+	otrLog("alice", "smp-failed", "")
+	evs, bad, broken, e := evRead()
+	if e != nil || bad != 0 || broken != 0 || len(evs) != 5 || evs[4].Seq != 5 {
+		t.Errorf("%d records, %d unreadable, %d out of sequence, %v", len(evs), bad, broken, e)
+	}
+}
+
+func TestEventSealedNeedsUnlock(t *testing.T) {
+	testJournal(t, true)
+	storePass, evKey = nil, nil
+	if _, _, _, e := evRead(); e == nil {
+		t.Error("read a sealed journal without the passphrase")
+	}
+}
@@ -0,0 +1,423 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// files only ever travel inside an established encrypted session, as CTCP-ish
+// lines the other side's client eats before they're shown:
+//
+//	FILE OFFER <id> <size> <sha256> <base64 name>
+//	FILE NEXT <id> <chunk>              accept, resume or retry from chunk
+//	FILE DATA <id> <chunk> <sha256> <base64 data>
+//	FILE DONE|FAILED|REJECT <id>
+const (
+	fileChunk   = 1024
+	filePace    = time.Second     // between chunks, so the server doesn't flood us off
+	maxFilesIn  = 16              // offers and downloads at once, from everyone
+	maxNickFile = 4               // of those from any one nick
+	fileIdle    = 5 * time.Minute // a transfer nobody moves along is dropped
+	fileRetries = 5               // asks for the same chunk again before we give up
+)
+
+type fileOut struct {
+	rcpt, name string
+	data, hash []byte
+	sent       int  // last chunk sent, -1 before the first
+	busy       bool // a chunk is on its way, NEXTs until then are ignored
+	retries    int
+	last       time.Time
+}
+
+type fileIn struct {
+	name string
+	size int64
+	hash []byte
+	next int
+	f    *os.File
+	last time.Time
+}
+
+var (
+	filesOut = make(map[string]*fileOut) // by id
+	filesIn  = make(map[string]*fileIn)  // by nick + " " + id
+)
+
+func fileChunks(size int64) int {
+	return int((size + fileChunk - 1) / fileChunk)
+}
+
+// by pointer, an id can be reused and a nick change moves the key
+func (fo *fileOut) touch(id string) {
+	at := time.Now()
+	fo.last = at
+	time.AfterFunc(fileIdle, func() {
+		post(func() {
+			if cur, ok := filesOut[id]; ok && cur == fo && fo.last.Equal(at) {
+				delete(filesOut, id)
+				PrintLine("FILE: " + ansiColour("Red", "Gave up sending "+fo.name+" to "+fo.rcpt) + ", nothing from them in " + fileIdle.String())
+			}
+		})
+	})
+}
+
+func (in *fileIn) touch() {
+	at := time.Now()
+	in.last = at
+	time.AfterFunc(fileIdle, func() {
+		post(func() {
+			for k, cur := range filesIn {
+				if cur == in && in.last.Equal(at) {
+					fileDrop(k)
+					PrintLine("FILE: " + ansiColour("Red", "Dropped "+in.name) + ", nothing happened with it in " + fileIdle.String())
+				}
+			}
+		})
+	})
+}
+
+// the .part stays for a later resume
+func fileDrop(key string) {
+	if in, ok := filesIn[key]; ok && in.f != nil {
+		in.f.Close()
+	}
+	delete(filesIn, key)
+}
+
+func SendFile(rcpt, path string) {
+	if b := backendFor(rcpt); !b.IsEncrypted(rcpt) || b.Trust(rcpt) == TrustRevoked {
+		PrintLine("FILE: Files only go over an encrypted session with a key you haven't revoked")
+		return
+	}
+	fi, e := os.Stat(path)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	if !fi.Mode().IsRegular() || fi.Size() > *maxFile {
+		PrintLine("FILE: " + path + " isn't a regular file of at most -max-file " + strconv.FormatInt(*maxFile, 10) + " bytes")
+		return
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	// it can still grow between the Stat and here
+	data, e := ioutil.ReadAll(io.LimitReader(f, *maxFile+1))
+	f.Close()
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	if int64(len(data)) > *maxFile {
+		PrintLine("FILE: " + path + " is larger than -max-file " + strconv.FormatInt(*maxFile, 10))
+		return
+	}
+	h := sha256.Sum256(data)
+	id := make([]byte, 4)
+	rand.Read(id)
+	fo := &fileOut{rcpt: strings.ToLower(rcpt), name: filepath.Base(path), data: data, hash: h[:], sent: -1}
+	if !backendFor(rcpt).Control(rcpt, "FILE", "OFFER", hex.EncodeToString(id), strconv.Itoa(len(data)), hex.EncodeToString(fo.hash),
+		base64.StdEncoding.EncodeToString([]byte(fo.name))) {
+		PrintLine("FILE: " + ansiColour("Red", "Not offered, sending to "+rcpt+" is blocked"))
+		return
+	}
+	filesOut[hex.EncodeToString(id)] = fo
+	fo.touch(hex.EncodeToString(id))
+	PrintLine("FILE: Offered " + fo.name + " (" + strconv.Itoa(len(data)) + " bytes) to " + rcpt + ", waiting for them to accept")
+}
+
+func fileSendChunk(id string, n int) {
+	fo, ok := filesOut[id]
+	if !ok {
+		return
+	}
+	fo.busy = false
+	fo.sent = n
+	end := (n + 1) * fileChunk
+	if end > len(fo.data) {
+		end = len(fo.data)
+	}
+	chunk := fo.data[n*fileChunk : end]
+	h := sha256.Sum256(chunk)
+	if !backendFor(fo.rcpt).Control(fo.rcpt, "FILE", "DATA", id, strconv.Itoa(n), hex.EncodeToString(h[:]), base64.StdEncoding.EncodeToString(chunk)) {
+		PrintLine("FILE: Lost the encrypted session with " + fo.rcpt + ", send " + fo.name + " again to resume")
+		delete(filesOut, id)
+	}
+}
+
+func fileIncoming(nick, id string) string {
+	return strings.ToLower(nick) + " " + id
+}
+
+// an offer we can't take any more of is refused, not queued
+func fileRoom(nick string) bool {
+	if len(filesIn) >= maxFilesIn {
+		return false
+	}
+	n := 0
+	for k := range filesIn {
+		if from, _ := split(k, " "); from == strings.ToLower(nick) {
+			n++
+		}
+	}
+	return n < maxNickFile
+}
+
+// transfers follow a NICK like sessions do, or they'd stall halfway
+func FileNick(from, to string) {
+	from = strings.ToLower(from)
+	to = strings.ToLower(to)
+	if from == to {
+		return
+	}
+	for _, fo := range filesOut {
+		if fo.rcpt == from {
+			fo.rcpt = to
+		}
+	}
+	for k, in := range filesIn {
+		if nick, id := split(k, " "); nick == from {
+			delete(filesIn, k)
+			filesIn[fileIncoming(to, id)] = in
+		}
+	}
+}
+
+// partial downloads are named by content hash, so only the same file resumes
+func (in *fileIn) partPath() string {
+	return filepath.Join(*downloadDir, "."+hex.EncodeToString(in.hash)+".part")
+}
+
+func AcceptFile(nick, id string) {
+	in, ok := filesIn[fileIncoming(nick, id)]
+	if !ok || in.f != nil {
+		PrintLine("FILE: No pending offer " + id + " from " + nick)
+		return
+	}
+	if _, e := os.Stat(filepath.Join(*downloadDir, in.name)); e == nil {
+		PrintLine("FILE: " + in.name + " already exists in " + *downloadDir + ", move it away first")
+		return
+	}
+	if e := os.MkdirAll(*downloadDir, 0700); e != nil {
+		PrintError(e)
+		return
+	}
+	f, e := os.OpenFile(in.partPath(), os.O_RDWR|os.O_CREATE, 0600)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	fi, e := f.Stat()
+	if e != nil {
+		f.Close()
+		PrintError(e)
+		return
+	}
+	in.next = int(fi.Size() / fileChunk)
+	f.Truncate(int64(in.next) * fileChunk)
+	f.Seek(int64(in.next)*fileChunk, io.SeekStart)
+	in.f = f
+	if in.next >= fileChunks(in.size) {
+		fileComplete(nick, id, in) // empty, or all there but never renamed
+		return
+	}
+	if !backendFor(nick).Control(nick, "FILE", "NEXT", id, strconv.Itoa(in.next)) {
+		fileDrop(fileIncoming(nick, id))
+		PrintLine("FILE: " + ansiColour("Red", "Can't accept "+in.name+", sending to "+nick+" is blocked"))
+		return
+	}
+	in.touch()
+	if in.next > 0 {
+		PrintLine("FILE: Resuming " + in.name + " from chunk " + strconv.Itoa(in.next))
+	}
+}
+
+func RejectFile(nick, id string) {
+	in, ok := filesIn[fileIncoming(nick, id)]
+	if !ok {
+		PrintLine("FILE: No offer " + id + " from " + nick)
+		return
+	}
+	fileDrop(fileIncoming(nick, id))
+	if !backendFor(nick).Control(nick, "FILE", "REJECT", id) {
+		PrintLine("FILE: Dropped " + in.name + " from " + nick + ", couldn't tell them")
+		return
+	}
+	PrintLine("FILE: Rejected " + in.name + " from " + nick)
+}
+
+func Files() {
+	for id, fo := range filesOut {
+		PrintLine("FILE: Sending " + fo.name + " to " + fo.rcpt + " [" + id + "]")
+	}
+	for k, in := range filesIn {
+		nick, id := split(k, " ")
+		state := "waiting for /accept-file " + nick + " " + id
+		if in.f != nil {
+			state = "chunk " + strconv.Itoa(in.next) + "/" + strconv.Itoa(fileChunks(in.size))
+		}
+		PrintLine("FILE: Receiving " + in.name + " from " + nick + " [" + id + "] " + state)
+	}
+}
+
+func fileComplete(nick, id string, in *fileIn) {
+	if e := fileFinish(fileIncoming(nick, id), in); e != nil {
+		PrintLine("FILE: " + ansiColour("Red", "Failed to receive "+in.name+" from "+nick+": "+e.Error()))
+		backendFor(nick).Control(nick, "FILE", "FAILED", id) // they time out if this doesn't get there
+		return
+	}
+	PrintLine("FILE: " + ansiColour("Green", "Received "+in.name+" from "+nick) + ", saved in " + *downloadDir)
+	if !backendFor(nick).Control(nick, "FILE", "DONE", id) {
+		PrintLine("FILE: Couldn't tell " + nick + " it arrived, they'll give up on their own")
+	}
+}
+
+func fileFinish(key string, in *fileIn) error {
+	defer delete(filesIn, key)
+	in.f.Seek(0, io.SeekStart)
+	h := sha256.New()
+	io.Copy(h, in.f)
+	in.f.Close()
+	if !bytes.Equal(h.Sum(nil), in.hash) {
+		os.Remove(in.partPath())
+		return errors.New("checksum mismatch")
+	}
+	return os.Rename(in.partPath(), filepath.Join(*downloadDir, in.name))
+}
+
+// eats FILE lines from an encrypted session, true if it was one
+func FileRecv(m *Msg) bool {
+	if !strings.HasPrefix(m.content, "\x01FILE ") || !strings.HasSuffix(m.content, "\x01") {
+		return false
+	}
+	if !m.enc {
+		PrintLine("FILE: Ignored an unencrypted file transfer message from " + m.nick)
+		return true
+	}
+	args := strings.Fields(strings.Trim(m.content, "\x01"))[1:]
+	if len(args) < 2 {
+		return true
+	}
+	cmd, id := args[0], args[1]
+	key := fileIncoming(m.nick, id)
+	switch {
+	case cmd == "OFFER" && len(args) == 5:
+		size, e1 := strconv.ParseInt(args[2], 10, 64)
+		hash, e2 := hex.DecodeString(args[3])
+		name, e3 := base64.StdEncoding.DecodeString(args[4])
+		base := filepath.Base(string(name))
+		if e1 != nil || e2 != nil || e3 != nil || len(hash) != sha256.Size || size < 0 || base != string(name) || strings.HasPrefix(base, ".") {
+			PrintLine("FILE: Ignored a malformed offer from " + m.nick)
+			return true
+		}
+		if size > *maxFile {
+			PrintLine("FILE: " + m.nick + " offered " + base + " (" + args[2] + " bytes), larger than -max-file")
+			backendFor(m.nick).Control(m.nick, "FILE", "REJECT", id)
+			return true
+		}
+		if _, ok := filesIn[key]; ok {
+			return true // already offered, ignore the repeat
+		}
+		if !fileRoom(m.nick) {
+			PrintLine("FILE: Refused " + base + " from " + m.nick + ", too many transfers already waiting")
+			backendFor(m.nick).Control(m.nick, "FILE", "REJECT", id)
+			return true
+		}
+		in := &fileIn{name: base, size: size, hash: hash}
+		filesIn[key] = in
+		in.touch()
+		PrintLine("FILE: " + m.nick + " offers " + ansiColour("Yellow", base) + " (" + args[2] + " bytes, sha256 " + args[3] + "). " +
+			"'/accept-file " + m.nick + " " + id + "' saves it to " + *downloadDir + ", '/reject-file " + m.nick + " " + id + "' declines.")
+	case cmd == "DATA" && len(args) == 5:
+		in, ok := filesIn[key]
+		n, e := strconv.Atoi(args[2])
+		if !ok || in.f == nil || e != nil || n != in.next {
+			return true
+		}
+		chunk, e := base64.StdEncoding.DecodeString(args[4])
+		h := sha256.Sum256(chunk)
+		in.touch()
+		if e == nil && hex.EncodeToString(h[:]) == args[3] && len(chunk) <= fileChunk {
+			if _, e := in.f.Write(chunk); e != nil {
+				PrintError(e)
+				return true
+			}
+			in.next++
+		} // else the same one once more please
+		if in.next >= fileChunks(in.size) {
+			fileComplete(m.nick, id, in)
+		} else if !backendFor(m.nick).Control(m.nick, "FILE", "NEXT", id, strconv.Itoa(in.next)) {
+			fileDrop(key)
+			PrintLine("FILE: Lost the encrypted session with " + m.nick + ", " + in.name + " resumes when they send it again")
+		}
+		return true
+	case cmd == "NEXT" && len(args) == 3:
+		fo, ok := filesOut[id]
+		n, e := strconv.Atoi(args[2])
+		if !ok || fo.rcpt != strings.ToLower(m.nick) || e != nil || n < 0 || n >= fileChunks(int64(len(fo.data))) || fo.busy {
+			return true
+		}
+		// one chunk out at a time: the one just sent again, or the one after it.
+		// the first NEXT can be anywhere, that's a resume
+		if fo.sent >= 0 && n != fo.sent && n != fo.sent+1 {
+			return true
+		}
+		if n == fo.sent {
+			if fo.retries++; fo.retries > fileRetries {
+				delete(filesOut, id)
+				backendFor(fo.rcpt).Control(fo.rcpt, "FILE", "FAILED", id)
+				PrintLine("FILE: " + ansiColour("Red", "Gave up sending "+fo.name+" to "+fo.rcpt) + ", chunk " + args[2] + " kept failing")
+				return true
+			}
+		} else {
+			fo.retries = 0
+		}
+		fo.busy = true
+		fo.touch(id)
+		time.AfterFunc(filePace, func() {
+			post(func() { fileSendChunk(id, n) })
+		})
+	case cmd == "DONE" || cmd == "FAILED" || cmd == "REJECT":
+		fo, ok := filesOut[id]
+		if !ok || fo.rcpt != strings.ToLower(m.nick) {
+			return true
+		}
+		delete(filesOut, id)
+		if cmd == "DONE" {
+			PrintLine("FILE: " + ansiColour("Green", m.nick+" received "+fo.name))
+		} else {
+			PrintLine("FILE: " + ansiColour("Red", m.nick+" "+strings.ToLower(cmd)+" "+fo.name))
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stands in for OTR, records control lines and can refuse them like a blocked session would
+type testBackend struct {
+	otrBackend
+	sent *[]string
+	up   *bool
+}
+
+func (b testBackend) IsEncrypted(rcpt string) bool { return *b.up }
+func (b testBackend) Trust(rcpt string) Trust      { return TrustSmp }
+func (b testBackend) Control(rcpt string, args ...string) bool {
+	if !*b.up {
+		return false
+	}
+	*b.sent = append(*b.sent, strings.Join(args, " "))
+	return true
+}
+
+func testFiles(t *testing.T) (*[]string, *bool) {
+	var sent []string
+	up := true
+	old := e2eDefault
+	e2eDefault = testBackend{sent: &sent, up: &up}
+	OTR = &OtrConf{conv: make(map[string]*OtrSession), Backend: make(map[string]string)}
+	filesIn = make(map[string]*fileIn)
+	filesOut = make(map[string]*fileOut)
+	t.Cleanup(func() { e2eDefault = old })
+	return &sent, &up
+}
+
+func fileLine(nick string, args ...string) *Msg {
+	return &Msg{nick: nick, enc: true, content: "\x01FILE " + strings.Join(args, " ") + "\x01"}
+}
+
+func TestFileControlFails(t *testing.T) {
+	sent, up := testFiles(t)
+	path := filepath.Join(t.TempDir(), "note.txt")
+	os.WriteFile(path, []byte("hello"), 0600)
+	*up = false
+	SendFile("alice", path)
+	if len(filesOut) > 0 {
+		t.Error("an offer that never went out is still waiting")
+	}
+	*up = true
+	FileRecv(fileLine("alice", "OFFER", "abcd", "5", strings.Repeat("00", 32), "bm90ZS50eHQ="))
+	if len(filesIn) != 1 {
+		t.Fatal("offer not taken")
+	}
+	dir := *downloadDir
+	*downloadDir = t.TempDir()
+	defer func() { *downloadDir = dir }()
+	*up = false
+	AcceptFile("alice", "abcd")
+	if len(filesIn) > 0 {
+		t.Error("an accept that never went out still holds a slot")
+	}
+	if len(*sent) > 0 {
+		t.Errorf("sent %q through a blocked session", *sent)
+	}
+}
+
+func TestFileOneChunkAtATime(t *testing.T) {
+	sent, _ := testFiles(t)
+	data := make([]byte, 10*fileChunk)
+	filesOut["abcd"] = &fileOut{rcpt: "alice", name: "f", data: data, sent: -1}
+	fo := filesOut["abcd"]
+	steps := []struct {
+		next    string
+		send    bool // a chunk gets scheduled
+		deliver int  // then goes out, -1 if nothing was scheduled
+	}{
+		{"3", true, 3}, // a resume starts anywhere
+		{"9", false, -1},
+		{"4", true, 4},
+		{"4", true, 4}, // the same one again is fine
+		{"6", false, -1},
+		{"2", false, -1},
+	}
+	for k, s := range steps {
+		FileRecv(fileLine("alice", "NEXT", "abcd", s.next))
+		if fo.busy != s.send {
+			t.Fatalf("%d: NEXT %s scheduled %v, want %v", k, s.next, fo.busy, s.send)
+		}
+		FileRecv(fileLine("alice", "NEXT", "abcd", s.next)) // ignored while one is on its way
+		if s.deliver >= 0 {
+			fileSendChunk("abcd", s.deliver)
+		}
+	}
+	if n := len(*sent); n != 3 {
+		t.Errorf("sent %d chunks, want 3", n)
+	}
+	for k := 0; k < fileRetries; k++ {
+		FileRecv(fileLine("alice", "NEXT", "abcd", "4"))
+		fileSendChunk("abcd", 4)
+	}
+	if _, ok := filesOut["abcd"]; ok {
+		t.Error("still sending a chunk they keep asking for")
+	}
+	if last := (*sent)[len(*sent)-1]; last != "FILE FAILED abcd" {
+		t.Errorf("last sent %q, want them told it failed", last)
+	}
+}
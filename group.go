@@ -0,0 +1,349 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// channel messages sealed with a shared key, keys handed out over verified
+// encrypted sessions. on the wire: ?GRP1:<key id>:<base64 nonce || secretbox(nick \0 msg)>
+// any member can still pose as any other, it keeps the channel from the
+// server and everyone else, not members from each other.
+const (
+	grpPrefix = "?GRP1:"
+	// what others receive is ":nick!user@host PRIVMSG #chan :" + line + "\r\n" in 512,
+	// that prefix can run to ~170 bytes (30 nick, 10 user, 63 host, 50 channel)
+	// and leaves ~340 for ?GRP1:<8 hex>: and the base64 of 24 nonce + 16 tag +
+	// nick + \0 + text, so with a 30 byte nick about 175 bytes of text
+	grpMaxText = 170
+	grpOldKeys = 4 // kept after rotation for lines still in flight
+)
+
+type grpKey struct {
+	id  uint32
+	key *[32]byte
+}
+
+type grpChan struct {
+	keys    []grpKey // newest first
+	members map[string]bool
+}
+
+var (
+	grpChans  = make(map[string]*grpChan)
+	grpOffers = make(map[string]grpKey) // by channel + " " + nick, until /chan-key accept
+	grpJoined = make(map[string]bool)   // channels we're in, keys for others are ignored
+)
+
+// joins, parts and kicks of our own nick
+func GrpTrack(m *Msg) {
+	switch {
+	case m.cmd == "001":
+		grpJoined = make(map[string]bool)
+	case m.cmd == "JOIN" && strings.EqualFold(m.nick, myNick):
+		channel := m.rcpt
+		if len(channel) < 1 {
+			channel = m.content
+		}
+		grpJoined[strings.ToLower(channel)] = true
+	case m.cmd == "PART" && strings.EqualFold(m.nick, myNick):
+		delete(grpJoined, strings.ToLower(m.rcpt))
+	case m.cmd == "KICK" && strings.EqualFold(m.args, myNick):
+		delete(grpJoined, strings.ToLower(m.rcpt))
+	}
+}
+
+func newGrpKey() (grpKey, error) {
+	k := grpKey{key: new([32]byte)}
+	var id [4]byte
+	if _, e := io.ReadFull(rand.Reader, id[:]); e != nil {
+		return k, e
+	}
+	k.id = binary.BigEndian.Uint32(id[:])
+	_, e := io.ReadFull(rand.Reader, k.key[:])
+	return k, e
+}
+
+func (g *grpChan) add(k grpKey) {
+	g.keys = append([]grpKey{k}, g.keys...)
+	if len(g.keys) > grpOldKeys+1 {
+		for _, old := range g.keys[grpOldKeys+1:] {
+			wipe(old.key[:])
+		}
+		g.keys = g.keys[:grpOldKeys+1]
+	}
+}
+
+func (g *grpChan) find(id uint32) *grpKey {
+	for i := range g.keys {
+		if g.keys[i].id == id {
+			return &g.keys[i]
+		}
+	}
+	return nil
+}
+
+func grpSeal(k grpKey, nick, msg string) string {
+	var nonce [24]byte
+	io.ReadFull(rand.Reader, nonce[:])
+	sealed := secretbox.Seal(nonce[:], []byte(nick+"\x00"+msg), &nonce, k.key)
+	return grpPrefix + strconv.FormatUint(uint64(k.id), 16) + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// splits on rune boundaries so each sealed line stays under the server's limit
+func grpSplit(msg string) []string {
+	var out []string
+	for len(msg) > grpMaxText {
+		cut := grpMaxText
+		for cut > 0 && !utf8.RuneStart(msg[cut]) {
+			cut--
+		}
+		out = append(out, msg[:cut])
+		msg = msg[cut:]
+	}
+	return append(out, msg)
+}
+
+// false if rcpt isn't an encrypted channel
+func GrpSend(rcpt, msg string) bool {
+	g, ok := grpChans[strings.ToLower(rcpt)]
+	if !ok {
+		return false
+	}
+	for _, part := range grpSplit(msg) {
+		send <- "PRIVMSG " + rcpt + " :" + grpSeal(g.keys[0], myNick, part)
+	}
+	return true
+}
+
+func GrpRecv(m *Msg) {
+	if !strings.HasPrefix(m.content, grpPrefix) {
+		return
+	}
+	idhex, b64 := split(m.content[len(grpPrefix):], ":")
+	id, e := strconv.ParseUint(idhex, 16, 32)
+	sealed, e2 := base64.StdEncoding.DecodeString(b64)
+	g, ok := grpChans[strings.ToLower(m.rcpt)]
+	if e != nil || e2 != nil || len(sealed) < 24+secretbox.Overhead {
+		m.content = ansiColour("Magenta", "[malformed group message]")
+		return
+	}
+	var k *grpKey
+	if ok {
+		k = g.find(uint32(id))
+	}
+	if k == nil {
+		m.content = ansiColour("Magenta", "[group message under key "+idhex+" you don't have]")
+		return
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	plain, ok := secretbox.Open(nil, sealed[24:], &nonce, k.key)
+	if !ok {
+		m.content = ansiColour("Magenta", "[group message failed to decrypt]")
+		return
+	}
+	nick, msg := split(string(plain), "\x00")
+	if !strings.EqualFold(nick, m.nick) {
+		m.content = ansiColour("Magenta", "[group message claims to be from "+nick+"]") + " " + msg
+		return
+	}
+	m.content = msg
+	m.grp = true
+}
+
+func grpVerified(nick string) bool {
+	b := backendFor(nick)
+	tr := b.Trust(nick)
+	return b.IsEncrypted(nick) && (tr == TrustSmp || tr == TrustManual)
+}
+
+func grpShare(channel, nick string) bool {
+	g := grpChans[channel]
+	if !grpVerified(nick) {
+		PrintLine("GRP: Not sharing " + channel + "'s key with " + nick + ", no verified encrypted session")
+		return false
+	}
+	k := g.keys[0]
+	if !backendFor(nick).Control(nick, "CHANKEY", channel, strconv.FormatUint(uint64(k.id), 16), base64.StdEncoding.EncodeToString(k.key[:])) {
+		return false
+	}
+	g.members[strings.ToLower(nick)] = true
+	PrintLine("GRP: Shared " + channel + "'s key with " + nick)
+	return true
+}
+
+// CHANKEY lines come in over the backend next to the FILE ones, true if it was one
+func GrpKeyRecv(m *Msg) bool {
+	if !strings.HasPrefix(m.content, "\x01CHANKEY ") || !strings.HasSuffix(m.content, "\x01") {
+		return false
+	}
+	args := strings.Fields(strings.Trim(m.content, "\x01"))[1:]
+	if !m.enc || !grpVerified(m.nick) {
+		PrintLine("GRP: Ignored a channel key from " + m.nick + ", no verified encrypted session")
+		return true
+	}
+	if len(args) != 3 || !strings.HasPrefix(args[0], "#") {
+		return true
+	}
+	id, e := strconv.ParseUint(args[1], 16, 32)
+	raw, e2 := base64.StdEncoding.DecodeString(args[2])
+	if e != nil || e2 != nil || len(raw) != 32 {
+		PrintLine("GRP: Ignored a malformed channel key from " + m.nick)
+		return true
+	}
+	channel := strings.ToLower(args[0])
+	if !grpJoined[channel] {
+		wipe(raw)
+		PrintLine("GRP: Ignored a key for " + channel + " from " + m.nick + ", you aren't in that channel")
+		return true
+	}
+	k := grpKey{id: uint32(id), key: new([32]byte)}
+	copy(k.key[:], raw)
+	wipe(raw)
+	offer := channel + " " + strings.ToLower(m.nick)
+	if old, ok := grpOffers[offer]; ok {
+		wipe(old.key[:])
+	}
+	grpOffers[offer] = k
+	what := "a key"
+	if _, ok := grpChans[channel]; ok {
+		what = ansiColour("Yellow", "a replacement key")
+	}
+	PrintLine("GRP: " + m.nick + " offers " + what + " " + args[1] + " for " + ansiColour("Blue", channel) +
+		". '/chan-key " + channel + " accept " + m.nick + "' to use it, '/chan-key " + channel + " reject " + m.nick + "' to drop it")
+	return true
+}
+
+func GrpAccept(channel, nick string) {
+	offer := channel + " " + strings.ToLower(nick)
+	k, ok := grpOffers[offer]
+	if !ok {
+		PrintLine("GRP: No key offered for " + channel + " by " + nick)
+		return
+	}
+	delete(grpOffers, offer)
+	g, ok := grpChans[channel]
+	if !ok {
+		g = &grpChan{members: make(map[string]bool)}
+		grpChans[channel] = g
+	}
+	g.add(k)
+	g.members[strings.ToLower(nick)] = true
+	PrintLine("GRP: Using " + nick + "'s key " + strconv.FormatUint(uint64(k.id), 16) + " for " + ansiColour("Blue", channel) + ", what you say there is encrypted now")
+}
+
+func GrpReject(channel, nick string) {
+	offer := channel + " " + strings.ToLower(nick)
+	k, ok := grpOffers[offer]
+	if !ok {
+		PrintLine("GRP: No key offered for " + channel + " by " + nick)
+		return
+	}
+	wipe(k.key[:])
+	delete(grpOffers, offer)
+	PrintLine("GRP: Dropped " + nick + "'s key for " + channel)
+}
+
+func GrpNew(channel string) {
+	k, e := newGrpKey()
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	g, ok := grpChans[channel]
+	if !ok {
+		g = &grpChan{members: make(map[string]bool)}
+		grpChans[channel] = g
+	}
+	g.add(k)
+	PrintLine("GRP: New key " + strconv.FormatUint(uint64(k.id), 16) + " for " + ansiColour("Blue", channel) + ", '/chan-key " + channel + " share <nick>' to hand it out")
+}
+
+func GrpRotate(channel string) {
+	g, ok := grpChans[channel]
+	if !ok {
+		PrintLine("GRP: " + channel + " isn't encrypted")
+		return
+	}
+	GrpNew(channel)
+	for nick := range g.members {
+		if !grpShare(channel, nick) {
+			delete(g.members, nick)
+			PrintLine("GRP: " + ansiColour("Yellow", nick+" didn't get the new key"))
+		}
+	}
+}
+
+// the only way to revoke anyone: a new key for everyone else
+func GrpRemove(channel, nick string) {
+	g, ok := grpChans[channel]
+	if !ok {
+		PrintLine("GRP: " + channel + " isn't encrypted")
+		return
+	}
+	if !g.members[strings.ToLower(nick)] {
+		PrintLine("GRP: " + nick + " doesn't have " + channel + "'s key from us")
+		return
+	}
+	delete(g.members, strings.ToLower(nick))
+	PrintLine("GRP: Removed " + nick + " from " + channel + ", rotating the key")
+	GrpRotate(channel)
+}
+
+func GrpOff(channel string) {
+	g, ok := grpChans[channel]
+	if !ok {
+		PrintLine("GRP: " + channel + " isn't encrypted")
+		return
+	}
+	for _, k := range g.keys {
+		wipe(k.key[:])
+	}
+	delete(grpChans, channel)
+	PrintLine("GRP: Dropped the keys for " + channel + ", it's plaintext again")
+}
+
+func GrpList() {
+	var chans []string
+	for c := range grpChans {
+		chans = append(chans, c)
+	}
+	sort.Strings(chans)
+	for _, c := range chans {
+		g := grpChans[c]
+		var members []string
+		for m := range g.members {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		PrintLine("GRP: " + ansiColour("Blue", c) + " key " + strconv.FormatUint(uint64(g.keys[0].id), 16) + ", shared with " + strings.Join(members, ","))
+	}
+	if len(chans) < 1 {
+		PrintLine("GRP: No encrypted channels")
+	}
+}
@@ -0,0 +1,42 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGrpRemoveRotates(t *testing.T) {
+	sent, _ := testFiles(t)
+	grpChans = make(map[string]*grpChan)
+	GrpNew("#c")
+	g := grpChans["#c"]
+	g.members["alice"] = true
+	g.members["bob"] = true
+	old := g.keys[0].id
+	GrpRemove("#c", "Bob")
+	if g.members["bob"] || !g.members["alice"] {
+		t.Errorf("members %v, want alice only", g.members)
+	}
+	if g.keys[0].id == old || g.find(old) == nil {
+		t.Error("no new key, or the old one is gone before lines in flight arrive")
+	}
+	if len(*sent) != 1 || !strings.HasPrefix((*sent)[0], "CHANKEY #c ") {
+		t.Errorf("sent %q, want the new key to alice only", *sent)
+	}
+}
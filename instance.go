@@ -0,0 +1,121 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// x/crypto/otr only speaks OTRv2, which has no instance tags, so a contact
+// behind a bouncer with two clients looks like one nick whose key keeps
+// changing. per-instance sessions aren't doable on top of it: v3 tags sit
+// inside the MACed data and the AKE, so they can't be stripped to feed the v2
+// code or added to what it sends, that takes a library that speaks v3. until
+// then we can't address their clients separately, but we can tell the user
+// that's what's going on instead of crying MITM every other message.
+type otrInstance struct {
+	fp   []byte // nil for a v3 tag we only saw in passing
+	tag  uint32
+	seen time.Time
+}
+
+const otrFlapWindow = 10 * time.Minute
+
+var (
+	otrInstances  = make(map[string][]*otrInstance)
+	otrFlapWarned = make(map[string]bool)
+)
+
+func otrSeenInstance(rcpt string, fp []byte, tag uint32) {
+	for _, in := range otrInstances[rcpt] {
+		if (fp != nil && bytes.Equal(in.fp, fp)) || (fp == nil && in.tag == tag) {
+			in.seen = time.Now()
+			return
+		}
+	}
+	otrInstances[rcpt] = append(otrInstances[rcpt], &otrInstance{fp: fp, tag: tag, seen: time.Now()})
+	if fp == nil {
+		PrintLine("OTR: " + rcpt + " also runs an OTRv3 client (instance " + strconv.FormatUint(uint64(tag), 16) + "), only v2 sessions are possible here")
+		return
+	}
+	if n := otrRecentKeys(rcpt); n > 1 && !otrFlapWarned[rcpt] {
+		otrFlapWarned[rcpt] = true
+		PrintLine("OTR: " + ansiColour("Yellow", rcpt+" looks connected from "+strconv.Itoa(n)+" OTR clients at once") + ", sessions will flip between them. '/otr-instances " + rcpt + "' lists them, ask them to close one.")
+		otrLog(rcpt, "instances", strconv.Itoa(n)+" keys in use")
+	}
+}
+
+func otrRecentKeys(rcpt string) int {
+	n := 0
+	for _, in := range otrInstances[rcpt] {
+		if in.fp != nil && time.Since(in.seen) < otrFlapWindow {
+			n++
+		}
+	}
+	return n
+}
+
+// instance tags from v3 messages and fragments, which the library refuses
+func otrInstanceTag(in string) (uint32, bool) {
+	if strings.HasPrefix(in, "?OTR|") {
+		parts := strings.SplitN(in[len("?OTR|"):], "|", 2)
+		tag, e := strconv.ParseUint(parts[0], 16, 32)
+		return uint32(tag), e == nil
+	}
+	if !strings.HasPrefix(in, "?OTR:") {
+		return 0, false
+	}
+	in = strings.TrimSuffix(in[len("?OTR:"):], ".")
+	msg, e := base64.StdEncoding.DecodeString(in)
+	if e != nil || len(msg) < 7 || msg[0] != 0 || msg[1] != 3 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(msg[3:7]), true
+}
+
+func otrInstancesNick(from, to string) {
+	if in, ok := otrInstances[from]; ok {
+		otrInstances[to] = in
+		delete(otrInstances, from)
+	}
+	delete(otrFlapWarned, from)
+}
+
+func OtrInstances(rcpt string) {
+	rcpt = strings.ToLower(rcpt)
+	current := theirFingerprint(rcpt)
+	for _, in := range otrInstances[rcpt] {
+		s := "v3 instance " + strconv.FormatUint(uint64(in.tag), 16)
+		if in.fp != nil {
+			s = "v2 key " + hex.EncodeToString(in.fp)
+		}
+		s += ", last seen " + in.seen.Format("15:04:05")
+		if bytes.Equal(in.fp, current) && current != nil {
+			s = ansiColour("Green", s+" (active)")
+		}
+		PrintLine("OTR: " + rcpt + " " + s)
+	}
+	if len(otrInstances[rcpt]) < 1 {
+		PrintLine("OTR: No OTR clients seen for " + rcpt)
+	}
+}
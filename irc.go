@@ -18,6 +18,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"net"
 	"strings"
 	"time"
@@ -25,7 +26,7 @@ import (
 
 type Msg struct {
 	timestamp, nick, user, host, cmd, rcpt, content, args string
-	enc                                                   bool
+	enc, grp                                              bool
 }
 
 func split(s, d string) (string, string) {
@@ -39,6 +40,14 @@ func split(s, d string) (string, string) {
 	}
 }
 
+// "NICK :new" and "NICK new" are both fine
+func (m *Msg) newNick() string {
+	if len(m.content) > 0 {
+		return m.content
+	}
+	return m.rcpt
+}
+
 func Parse(line string) *Msg {
 	line = strings.TrimRight(line, "\r\n")
 	m := new(Msg)
@@ -56,48 +65,121 @@ func Parse(line string) *Msg {
 	return m
 }
 
+// IRCv3 allows 8191 bytes of tags on top of the 512 byte message
+const maxLine = 8191 + 512
+
+var droppedLines = 0
+
+// like ReadString('\n') but a hostile server can't make us buffer forever,
+// anything longer than the reader's buffer is skipped up to the next newline
+func readLine(i *bufio.Reader) (string, error) {
+	for {
+		b, e := i.ReadSlice('\n')
+		if e == nil {
+			return string(b), nil
+		} else if e != bufio.ErrBufferFull {
+			return "", e
+		}
+		for e == bufio.ErrBufferFull {
+			_, e = i.ReadSlice('\n')
+		}
+		if e != nil {
+			return "", e
+		}
+		droppedLines++
+		warning := fmt.Errorf("dropped overlong line from server (%d so far)", droppedLines)
+		post(func() { PrintError(warning) })
+	}
+}
+
 func parseLoop() {
-	i := bufio.NewReader(conn)
+	i := bufio.NewReaderSize(conn, maxLine)
 	for {
-		if s, e := i.ReadString('\n'); e != nil {
-			PrintError(e)
+		if s, e := readLine(i); e != nil {
+			post(func() { PrintError(e) })
 			return
 		} else {
 			m := Parse(s)
-			if _, ok := IgnoreMap[m.nick]; ok {
-				continue
-			}
-			if m.cmd == "PRIVMSG" && strings.HasPrefix(m.rcpt, "#") == false {
-				OtrRecv(m)
-				out <- m
-			} else if m.cmd == "PING" {
+			if m.cmd == "PING" {
 				Raw("PONG :" + m.content)
 			} else {
-				out <- m
+				postLine(func() { handleMsg(m) })
 			}
 		}
 	}
 }
 
+func handleMsg(m *Msg) {
+	trackNick(m)
+	GrpTrack(m)
+	CheckHost(m)
+	if _, ok := IgnoreMap[m.nick]; ok {
+		return
+	}
+	if m.cmd == "PRIVMSG" && strings.HasPrefix(m.rcpt, "#") == false {
+		backendFor(m.nick).Recv(m)
+		if FileRecv(m) || GrpKeyRecv(m) {
+			return
+		}
+	} else if m.cmd == "PRIVMSG" {
+		GrpRecv(m)
+	} else if m.cmd == "NICK" {
+		followNick(m)
+		E2eNick(m.nick, m.newNick())
+		FileNick(m.nick, m.newNick())
+	}
+	inbox.push(uiEvent{m: m})
+}
+
+func trackNick(m *Msg) {
+	switch {
+	case m.cmd == "001": // RPL_WELCOME, ask the server how it sees us
+		myNick = m.rcpt
+		send <- "WHOIS " + myNick
+	case m.cmd == "NICK" && strings.EqualFold(m.nick, myNick):
+		myNick = m.newNick()
+	}
+}
+
 func sendLoop() {
 	for {
 		s := <-send
 		_, e := conn.Write([]byte(s + "\r\n"))
 		if e != nil {
-			PrintError(e)
+			post(func() { PrintError(e) })
 			return
 		}
 	}
 }
 
 var (
-	out  chan *Msg
-	send chan string
-	conn net.Conn
+	inbox    *msgQueue
+	send     chan string
+	conn     net.Conn
+	endpoint *Endpoint
+	myNick   string
 )
 
+// CTCPs say what client we run and when we're around, so they go the way
+// messages do: inside a session if there is one, never in plaintext to "require"
 func Ctcp(rcpt, msg string) {
-	send <- "PRIVMSG " + rcpt + " :\x01" + msg + "\x01"
+	line := "\x01" + msg + "\x01"
+	b := backendFor(rcpt)
+	switch {
+	case strings.HasPrefix(rcpt, "#"):
+		if !GrpSend(rcpt, line) {
+			send <- "PRIVMSG " + rcpt + " :" + line
+		}
+	case b.IsEncrypted(rcpt):
+		if !b.Control(rcpt, msg) {
+			PrintLine("CTCP: " + ansiColour("Red", "Not sent, sending to "+rcpt+" is blocked"))
+		}
+	case otrPolicy(rcpt) == PolicyRequire:
+		otrLog(rcpt, "refused", "plaintext CTCP to them (policy require)")
+		PrintLine("CTCP: " + ansiColour("Red", "Not sent, "+rcpt+" requires encryption") + ", '/otr-start " + rcpt + "' first")
+	default:
+		send <- "PRIVMSG " + rcpt + " :" + line
+	}
 }
 
 func SendTo(rcpt, msg string) {
@@ -105,9 +187,11 @@ func SendTo(rcpt, msg string) {
 		return
 	}
 	if strings.HasPrefix(rcpt, "#") {
-		send <- "PRIVMSG " + rcpt + " :" + msg
+		if !GrpSend(rcpt, msg) {
+			send <- "PRIVMSG " + rcpt + " :" + msg
+		}
 	} else {
-		OtrSend(rcpt, msg)
+		backendFor(rcpt).Send(rcpt, msg)
 	}
 }
 
@@ -116,6 +200,7 @@ func Join(channel string) {
 }
 
 func Register(nick string) {
+	myNick = nick
 	send <- "USER " + nick + " * localhost :" + nick
 	send <- "NICK " + nick
 }
@@ -129,9 +214,7 @@ func Part(channel string) {
 }
 
 func Quit(reason string) {
-	for rcpt := range OTR.conv {
-		OtrEnd(rcpt)
-	}
+	E2eEndAll()
 	send <- "QUIT :Leaving."
 }
 
@@ -139,15 +222,15 @@ func Raw(raw string) {
 	send <- raw
 }
 
-func Init(server, proxy string, ssl bool) (chan *Msg, error) {
+func Init(eps []*Endpoint, proxy string, shuffle bool) (*msgQueue, error) {
 	var e error
-	out = make(chan *Msg, 256)
+	inbox = newMsgQueue(1024)
 	send = make(chan string, 256)
-	conn, e = Connect(server, proxy, ssl)
+	conn, endpoint, e = Connect(eps, proxy, shuffle)
 	if e != nil {
 		return nil, e
 	}
 	go parseLoop()
 	go sendLoop()
-	return out, nil
+	return inbox, nil
 }
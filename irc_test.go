@@ -0,0 +1,61 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLineDropsOverlong(t *testing.T) {
+	defer func() {
+		loopLock.Lock()
+		loopQueue = nil // the warnings, nothing runs them here
+		loopLock.Unlock()
+	}()
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		in      string
+		want    []string
+		dropped int
+	}{
+		{"a\nb\n", []string{"a\n", "b\n"}, 0},
+		{"short\n" + long + "\nnext\n", []string{"short\n", "next\n"}, 1},
+		{long + "\n" + long + "\n" + long[:15] + "\n", []string{long[:15] + "\n"}, 2},
+		{"0123456789abcde\n", []string{"0123456789abcde\n"}, 0}, // exactly fills the buffer
+		{long, nil, 0}, // never ends, nothing buffered forever
+	}
+	for _, tt := range tests {
+		droppedLines = 0
+		i := bufio.NewReaderSize(strings.NewReader(tt.in), 16)
+		var got []string
+		for {
+			s, e := readLine(i)
+			if e == io.EOF {
+				break
+			} else if e != nil {
+				t.Fatal(e)
+			}
+			got = append(got, s)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || droppedLines != tt.dropped {
+			t.Errorf("%.20q: got %q, %d dropped, want %q, %d", tt.in, got, droppedLines, tt.want, tt.dropped)
+		}
+	}
+}
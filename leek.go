@@ -16,51 +16,389 @@
 */
 package main
 
-import "strings"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
 
+// a Leek turns bytes into words, one list of 65536 (two bytes a word) or
+// 256 (one byte a word), or several used in turn like the PGP even/odd lists
 type Leek struct {
-	findWord  map[uint16]string
-	findValue map[string]uint16
+	Name      string
+	lists     [][]string
+	findValue []map[string]int
 }
 
-func newLeek() *Leek {
-	l := &Leek{
-		findWord:  make(map[uint16]string),
-		findValue: make(map[string]uint16),
+func newLeek(name string, lists ...[]string) (*Leek, error) {
+	l := &Leek{Name: name, lists: lists}
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		if len(list) != 256 && len(list) != 65536 || len(list) != len(lists[0]) {
+			return nil, errors.New("Leek: " + name + " has " + strconv.Itoa(len(list)) + " words, a list needs 256 or 65536")
+		}
+		find := make(map[string]int)
+		for k, w := range list {
+			if len(w) < 1 || strings.IndexFunc(w, unicode.IsSpace) >= 0 || w != strings.ToLower(w) {
+				return nil, errors.New("Leek: " + name + " word " + strconv.Itoa(k+1) + " '" + w + "' should be one lower case word")
+			}
+			if seen[w] {
+				return nil, errors.New("Leek: " + name + " has '" + w + "' twice")
+			}
+			seen[w] = true
+			find[w] = k
+		}
+		l.findValue = append(l.findValue, find)
 	}
-	for c := 0; c < 65536; c++ {
-		l.findWord[uint16(c)] = leekwords[uint16(c)]
-		l.findValue[leekwords[uint16(c)]] = uint16(c)
+	return l, nil
+}
+
+// bytes per word
+func (l *Leek) width() int {
+	if len(l.lists[0]) == 256 {
+		return 1
 	}
-	return l
+	return 2
 }
 
-var leek = newLeek()
+var leek, _ = newLeek("leek", leekwords[:65536])
 
-func (l *Leek) Encode(d []byte) string {
+// the first 256 leekwords shaped like "ratel" or "vapor", no plurals, none sounding alike
+func easyWords() []string {
+	shape := regexp.MustCompile(`^[bdfghklmnprstvwy][aeiou](?:[bdfgklmnprstvz][aeiou]?|[bdfgklmnprstvz][aeiou][bdfgklmnprstz])$`)
+	sounds := make(map[string]bool)
 	var out []string
-	var w []uint16
-	for k, v := range d {
-		sv := uint16(v)
-		if k%2 > 0 {
-			w[k/2] |= sv
-		} else {
-			w = append(w, sv<<8&0xff)
+	for _, w := range leekwords[:65536] {
+		if len(out) == 256 {
+			break
 		}
+		if shape.MatchString(w) && !strings.HasSuffix(w, "s") && !sounds[soundex(w)] {
+			sounds[soundex(w)] = true
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// leek, pgp, easy, or a file with one word per line
+func LoadLeek(name string) (*Leek, error) {
+	switch name {
+	case "leek":
+		return newLeek(name, leekwords[:65536])
+	case "pgp":
+		return newLeek(name, pgpEvenWords, pgpOddWords)
+	case "easy":
+		return newLeek(name, easyWords())
+	}
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return nil, e
 	}
-	for _, v := range w {
-		out = append(out, l.findWord[v])
+	return newLeek(name, strings.Fields(string(d)))
+}
+
+// big endian, width bytes a word, a short last word padded with zeros
+func (l *Leek) Encode(d []byte) string {
+	var out []string
+	w := l.width()
+	for k := 0; k < len(d); k += w {
+		v := int(d[k])
+		if w == 2 {
+			v <<= 8
+			if k+1 < len(d) {
+				v |= int(d[k+1])
+			}
+		}
+		list := l.lists[(k/w)%len(l.lists)]
+		out = append(out, list[v])
 	}
 	return strings.Join(out, " ")
 }
 
-func (l *Leek) Decode(d string) []byte {
+// a word that isn't in the list, never read as zero
+type LeekUnknown struct {
+	Pos  int // 1-based
+	Word string
+	Near []string
+	Hint string
+}
+
+type LeekError []LeekUnknown
+
+func (e LeekError) Error() string {
+	var s []string
+	for _, u := range e {
+		w := "word " + strconv.Itoa(u.Pos) + " '" + u.Word + "' "
+		if len(u.Hint) > 0 {
+			w += u.Hint
+		} else {
+			w += "is not in the list"
+		}
+		if len(u.Near) > 0 {
+			w += ", did you mean " + strings.Join(u.Near, " or ") + "?"
+		}
+		s = append(s, w)
+	}
+	return strings.Join(s, "; ")
+}
+
+func (l *Leek) Decode(d string) ([]byte, error) {
 	var out []byte
-	words := strings.Split(d, " ")
-	for _, v := range words {
-		i := l.findValue[v]
+	var unknown LeekError
+	for k, v := range strings.Fields(strings.ToLower(d)) {
+		at := k % len(l.lists)
+		i, ok := l.findValue[at][v]
+		if !ok {
+			u := LeekUnknown{Pos: k + 1, Word: v, Near: l.suggest(at, v, leekMaxNear)}
+			for other := range l.findValue {
+				if _, ok := l.findValue[other][v]; ok {
+					u.Hint = "is out of place, a word before it was skipped or doubled"
+				}
+			}
+			unknown = append(unknown, u)
+			continue
+		}
+		if l.width() == 2 {
+			out = append(out, byte(i>>8))
+		}
 		out = append(out, byte(i&0xff))
-		out = append(out, byte(i>>8&0xff))
+	}
+	if unknown != nil {
+		return nil, unknown
+	}
+	return out, nil
+}
+
+const (
+	leekMaxNear = 3
+	leekMaxEdit = 2 // further off than this isn't a mishearing
+)
+
+// closest words in list at by edit distance, ties broken by sounding alike then alphabetically
+func (l *Leek) suggest(at int, w string, n int) []string {
+	type near struct {
+		word string
+		dist int
+	}
+	var found []near
+	sw := soundex(w)
+	for cand := range l.findValue[at] {
+		if abs(len(cand)-len(w)) > leekMaxEdit {
+			continue
+		}
+		d := levenshtein(w, cand)
+		if len(sw) > 0 && soundex(cand) == sw {
+			d-- // misheard rather than mistyped
+		}
+		if d <= leekMaxEdit {
+			found = append(found, near{cand, d})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].dist != found[j].dist {
+			return found[i].dist < found[j].dist
+		}
+		return found[i].word < found[j].word
+	})
+	var out []string
+	for k := 0; k < len(found) && k < n; k++ {
+		out = append(out, found[k].word)
 	}
 	return out
 }
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// american soundex, good enough to notice "sell" and "cell" sound alike
+func soundex(w string) string {
+	codes := "01230120022455012623010202"
+	var out []byte
+	var last byte
+	for i := 0; i < len(w) && len(out) < 4; i++ {
+		c := w[i]
+		if c < 'a' || c > 'z' {
+			continue
+		}
+		code := codes[c-'a']
+		if len(out) == 0 {
+			out = append(out, c)
+		} else if code != '0' && code != last {
+			out = append(out, code)
+		}
+		if c != 'h' && c != 'w' {
+			last = code
+		}
+	}
+	for len(out) < 4 && len(out) > 0 {
+		out = append(out, '0')
+	}
+	return string(out)
+}
+
+// how much of a fingerprint is read aloud, 0 for all of it
+var leekBytes = 10
+
+func LeekSetLength(s string) error {
+	switch s {
+	case "short":
+		leekBytes = 10
+	case "128":
+		leekBytes = 16
+	case "full":
+		leekBytes = 0
+	default:
+		return errors.New("Leek: length is short (80 bits), 128 or full, not " + s)
+	}
+	return nil
+}
+
+func leekShown(d []byte) []byte {
+	if leekBytes == 0 || leekBytes > len(d) {
+		return d
+	}
+	return d[:leekBytes]
+}
+
+// one extra word, so a misheard word shows up without the fingerprint at hand
+func leekSum(d []byte) []byte {
+	h := sha256.Sum256(d)
+	return h[:leek.width()]
+}
+
+// the words fingerprint() shows, with the checksum and in groups if asked for
+func LeekFingerprint(d []byte) string {
+	data := append([]byte{}, leekShown(d)...)
+	if *leekChecksum {
+		data = append(data, leekSum(data)...)
+	}
+	words := strings.Fields(leek.Encode(data))
+	if *leekGroup < 1 {
+		return strings.Join(words, " ")
+	}
+	var groups []string
+	for k := 0; k < len(words); k += *leekGroup {
+		end := k + *leekGroup
+		if end > len(words) {
+			end = len(words)
+		}
+		groups = append(groups, strings.Join(words[k:end], " "))
+	}
+	return strings.Join(groups, " / ")
+}
+
+// the live fingerprint words read aloud should match, "tls" for the server's certificate
+func leekTarget(who string) ([]byte, string) {
+	if strings.EqualFold(who, "tls") {
+		return tlsLeaf, "the server certificate"
+	}
+	b := backendFor(who)
+	return b.Fingerprint(who), who + "'s " + b.Name() + " key"
+}
+
+func LeekSetWords(name string) {
+	if len(name) < 1 {
+		length := strconv.Itoa(leekBytes*8) + " bits"
+		if leekBytes == 0 {
+			length = "whole fingerprints"
+		}
+		PrintLine("Leek: Using the " + leek.Name + " words, " + strconv.Itoa(8*leek.width()) + " bits a word, reading out " + length)
+		return
+	}
+	l, e := LoadLeek(name)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	leek = l
+	PrintLine("Leek: Now using the " + leek.Name + " words, make sure your contacts do too")
+}
+
+func LeekVerify(who, words string) {
+	fp, what := leekTarget(who)
+	if fp == nil {
+		PrintLine("Leek: No fingerprint for " + what + ", need an encrypted session (or 'tls')")
+		return
+	}
+	got, e := leek.Decode(strings.Replace(words, "/", " ", -1))
+	if e != nil {
+		PrintLine("Leek: " + ansiColour("Red", "Can't check, "+e.Error()))
+		return
+	}
+	w := leek.width()
+	if *leekChecksum && len(got) == len(leekShown(fp))+w {
+		sum := got[len(got)-w:]
+		got = got[:len(got)-w]
+		if !bytes.Equal(sum, leekSum(got)) {
+			PrintLine("Leek: " + ansiColour("Red", "Checksum word doesn't fit, one of the words was misheard"))
+			return
+		}
+	}
+	if len(got) < 2 {
+		PrintLine("Usage: /leek-verify <rcpt|tls> <words...>")
+		return
+	}
+	if len(got) > len(fp) {
+		PrintLine("Leek: Too many words, " + what + " is only " + strconv.Itoa(len(fp)/leek.width()) + " words long")
+		return
+	}
+	want := fp[:len(got)]
+	if !bytes.Equal(got, want) {
+		PrintLine("Leek: " + ansiColour("Red", "Words DO NOT match "+what))
+		heard := strings.Fields(leek.Encode(got))
+		for k, w := range strings.Fields(leek.Encode(want)) {
+			if heard[k] != w {
+				PrintLine("Leek: word " + strconv.Itoa(k+1) + " is " + ansiColour("Red", heard[k]) + ", expected " + ansiColour("Green", w))
+			}
+		}
+		return
+	}
+	if need := len(leekShown(fp)); len(got) < need {
+		PrintLine("Leek: " + ansiColour("Yellow", "So far so good, but that's only "+strconv.Itoa(len(got)*8)+" of "+strconv.Itoa(need*8)+" bits") + ", read out all the words")
+		return
+	}
+	PrintLine("Leek: " + ansiColour("Green", "Words match "+what) + " (" + strconv.Itoa(len(got)*8) + " bits)")
+	if !strings.EqualFold(who, "tls") && backendFor(who).Name() == "otr" {
+		PrintLine("Leek: '/otr-trust " + who + " leekspeak' marks it verified")
+	}
+}
@@ -0,0 +1,347 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testWords(n int) []string {
+	var out []string
+	for k := 0; k < n; k++ {
+		out = append(out, "w"+strconv.Itoa(k))
+	}
+	return out
+}
+
+// swaps the package's leek settings for a test, puts them back after
+func withLeek(t *testing.T, l *Leek, bytes int, group int, sum bool) {
+	oldLeek, oldBytes, oldGroup, oldSum := leek, leekBytes, *leekGroup, *leekChecksum
+	leek, leekBytes, *leekGroup, *leekChecksum = l, bytes, group, sum
+	t.Cleanup(func() {
+		leek, leekBytes, *leekGroup, *leekChecksum = oldLeek, oldBytes, oldGroup, oldSum
+	})
+}
+
+func testLeek(t *testing.T) *Leek {
+	words := testWords(256)
+	copy(words, []string{"cell", "sell", "bell", "apple", "maple", "zebra"})
+	l, e := newLeek("test", words)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return l
+}
+
+func TestLeekRoundTrip(t *testing.T) {
+	d := make([]byte, 32)
+	for k := range d {
+		d[k] = byte(k*37 + 11)
+	}
+	for _, name := range []string{"leek", "pgp", "easy"} {
+		l, e := LoadLeek(name)
+		if e != nil {
+			t.Fatalf("%s: %v", name, e)
+		}
+		for _, n := range []int{0, 1, 2, 10, 20, 32} {
+			in := d[:n]
+			got, e := l.Decode(l.Encode(in))
+			if e != nil {
+				t.Fatalf("%s %d bytes: %v", name, n, e)
+			}
+			want := in
+			if l.width() == 2 && n%2 == 1 {
+				want = append(append([]byte{}, in...), 0) // the short last word is padded
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s %d bytes: got %x, want %x", name, n, got, want)
+			}
+		}
+	}
+}
+
+func TestLeekDecode(t *testing.T) {
+	l := testLeek(t)
+	tests := []struct {
+		words   string
+		want    []byte
+		bad     []int  // positions reported unknown
+		suggest string // among the suggestions for the first bad word
+	}{
+		{words: "cell sell bell", want: []byte{0, 1, 2}},
+		{words: "Apple  ZEBRA", want: []byte{3, 5}},
+		{words: "w255 cell", want: []byte{255, 0}},
+		{words: "", want: nil},
+		{words: "cell xyzzy", bad: []int{2}},
+		{words: "aple zebra", bad: []int{1}, suggest: "apple"},
+		{words: "cell bel zebr", bad: []int{2, 3}, suggest: "bell"},
+	}
+	for _, tt := range tests {
+		got, e := l.Decode(tt.words)
+		if len(tt.bad) == 0 {
+			if e != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("%q: got %x, %v, want %x", tt.words, got, e, tt.want)
+			}
+			continue
+		}
+		le, ok := e.(LeekError)
+		if !ok || got != nil {
+			t.Errorf("%q: got %x, %v, want a LeekError and no bytes", tt.words, got, e)
+			continue
+		}
+		if len(le) != len(tt.bad) {
+			t.Errorf("%q: %d unknown words, want %d: %v", tt.words, len(le), len(tt.bad), le)
+			continue
+		}
+		for k, u := range le {
+			if u.Pos != tt.bad[k] {
+				t.Errorf("%q: unknown word at %d, want %d", tt.words, u.Pos, tt.bad[k])
+			}
+		}
+		if len(tt.suggest) > 0 && !strings.Contains(strings.Join(le[0].Near, " "), tt.suggest) {
+			t.Errorf("%q: suggested %v, want %s among them", tt.words, le[0].Near, tt.suggest)
+		}
+		if !strings.Contains(e.Error(), "word "+strconv.Itoa(tt.bad[0])) {
+			t.Errorf("%q: error %q doesn't name the position", tt.words, e)
+		}
+	}
+}
+
+func TestLeekSuggest(t *testing.T) {
+	l := testLeek(t)
+	tests := []struct {
+		word string
+		want []string
+	}{
+		{"cel", []string{"cell", "bell", "sell"}}, // sounding alike wins the tie
+		{"sel", []string{"sell", "bell", "cell"}},
+		{"aple", []string{"apple", "maple"}},
+		{"zebra", []string{"zebra"}},
+		{"xylophone", nil}, // too far off for anything
+	}
+	for _, tt := range tests {
+		got := l.suggest(0, tt.word, leekMaxNear)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("suggest(%q) = %v, want %v", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestSoundexLevenshtein(t *testing.T) {
+	for _, tt := range []struct{ a, b string }{
+		{"robert", "r163"}, {"rupert", "r163"}, {"ashcraft", "a261"}, {"tymczak", "t522"}, {"", ""},
+	} {
+		if got := soundex(tt.a); got != tt.b {
+			t.Errorf("soundex(%q) = %q, want %q", tt.a, got, tt.b)
+		}
+	}
+	for _, tt := range []struct {
+		a, b string
+		d    int
+	}{
+		{"kitten", "sitting", 3}, {"", "abc", 3}, {"same", "same", 0}, {"flaw", "lawn", 2},
+	} {
+		if got := levenshtein(tt.a, tt.b); got != tt.d {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.d)
+		}
+	}
+}
+
+func TestNewLeek(t *testing.T) {
+	dup := testWords(256)
+	dup[7] = "w3"
+	upper := testWords(256)
+	upper[9] = "Word"
+	space := testWords(256)
+	space[1] = "two words"
+	empty := testWords(256)
+	empty[0] = ""
+	tests := []struct {
+		name  string
+		lists [][]string
+		ok    bool
+	}{
+		{"256", [][]string{testWords(256)}, true},
+		{"65536", [][]string{testWords(65536)}, true},
+		{"short", [][]string{testWords(255)}, false},
+		{"long", [][]string{testWords(257)}, false},
+		{"duplicate", [][]string{dup}, false},
+		{"upper case", [][]string{upper}, false},
+		{"space", [][]string{space}, false},
+		{"empty word", [][]string{empty}, false},
+		{"same word in both lists", [][]string{testWords(256), testWords(256)}, false},
+		{"even and odd lists", [][]string{testWords(256), testWords(512)[256:]}, true},
+		{"second list too short", [][]string{testWords(256), testWords(512)[256:511]}, false},
+	}
+	for _, tt := range tests {
+		l, e := newLeek(tt.name, tt.lists...)
+		if (e == nil) != tt.ok || (l != nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, e, tt.ok)
+		}
+	}
+}
+
+func TestLoadLeek(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good")
+	os.WriteFile(good, []byte(strings.Join(testWords(256), "\n")+"\n"), 0600)
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte(strings.Join(testWords(200), " ")), 0600)
+	tests := []struct {
+		name  string
+		width int
+		ok    bool
+	}{
+		{"leek", 2, true},
+		{"pgp", 1, true},
+		{"easy", 1, true},
+		{good, 1, true},
+		{short, 0, false},
+		{filepath.Join(dir, "missing"), 0, false},
+	}
+	for _, tt := range tests {
+		l, e := LoadLeek(tt.name)
+		if (e == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, e)
+			continue
+		}
+		if tt.ok && l.width() != tt.width {
+			t.Errorf("%s: width %d, want %d", tt.name, l.width(), tt.width)
+		}
+	}
+}
+
+func TestLeekPgpEvenOdd(t *testing.T) {
+	pgp, _ := LoadLeek("pgp")
+	// the vector from the PGP word list's description
+	if got := pgp.Encode([]byte{0xe5, 0x82, 0x94, 0xf2}); got != "topmost istanbul pluto vagabond" {
+		t.Errorf("got %q", got)
+	}
+	// the same byte twice reads as two different words
+	if w := strings.Fields(pgp.Encode([]byte{0, 0})); w[0] != "aardvark" || w[1] != "adroitness" {
+		t.Errorf("got %v", w)
+	}
+	for k := 0; k < 256; k++ {
+		if pgpEvenWords[k] == pgpOddWords[k] {
+			t.Errorf("%d is %s in both lists", k, pgpEvenWords[k])
+		}
+	}
+	// a skipped or doubled word puts the rest on the wrong list, and says so
+	tests := []struct {
+		words string
+		bad   []int
+	}{
+		{"topmost istanbul pluto vagabond", nil},
+		{"istanbul topmost", []int{1, 2}},
+		{"topmost istanbul istanbul", []int{3}},
+		{"topmost pluto vagabond", []int{2, 3}},
+	}
+	for _, tt := range tests {
+		_, e := pgp.Decode(tt.words)
+		le, _ := e.(LeekError)
+		if len(le) != len(tt.bad) {
+			t.Errorf("%q: %v, want %d bad words", tt.words, e, len(tt.bad))
+			continue
+		}
+		for k, u := range le {
+			if u.Pos != tt.bad[k] || len(u.Hint) < 1 {
+				t.Errorf("%q: word %d hint %q, want an out of place word at %d", tt.words, u.Pos, u.Hint, tt.bad[k])
+			}
+		}
+	}
+}
+
+func TestLeekFingerprint(t *testing.T) {
+	easy, _ := LoadLeek("easy")
+	fp := make([]byte, 20)
+	for k := range fp {
+		fp[k] = byte(k + 1)
+	}
+	sum := sha256.Sum256(fp[:10])
+	tests := []struct {
+		l      *Leek
+		bytes  int
+		group  int
+		sum    bool
+		words  int
+		groups int
+		data   []byte
+	}{
+		{easy, 10, 0, false, 10, 1, fp[:10]},
+		{easy, 10, 4, false, 10, 3, fp[:10]},
+		{easy, 10, 4, true, 11, 3, append(append([]byte{}, fp[:10]...), sum[0])},
+		{easy, 0, 5, false, 20, 4, fp},
+		{easy, 16, 8, true, 17, 3, nil},
+		{leek, 10, 0, true, 6, 1, append(append([]byte{}, fp[:10]...), sum[:2]...)},
+		{leek, 0, 2, false, 10, 5, fp},
+	}
+	for k, tt := range tests {
+		withLeek(t, tt.l, tt.bytes, tt.group, tt.sum)
+		s := LeekFingerprint(fp)
+		if n := len(strings.Split(s, " / ")); n != tt.groups {
+			t.Errorf("%d: %q has %d groups, want %d", k, s, n, tt.groups)
+		}
+		plain := strings.Replace(s, "/", " ", -1)
+		if n := len(strings.Fields(plain)); n != tt.words {
+			t.Errorf("%d: %q has %d words, want %d", k, s, n, tt.words)
+		}
+		got, e := tt.l.Decode(plain)
+		if e != nil {
+			t.Errorf("%d: %q doesn't decode: %v", k, s, e)
+			continue
+		}
+		if tt.data != nil && !bytes.Equal(got, tt.data) {
+			t.Errorf("%d: decodes to %x, want %x", k, got, tt.data)
+		}
+		if tt.sum {
+			w := tt.l.width()
+			if !bytes.Equal(got[len(got)-w:], leekSum(got[:len(got)-w])) {
+				t.Errorf("%d: checksum word doesn't match", k)
+			}
+		}
+	}
+}
+
+func TestLeekSetLength(t *testing.T) {
+	withLeek(t, leek, leekBytes, *leekGroup, *leekChecksum)
+	for _, tt := range []struct {
+		s     string
+		bytes int
+		ok    bool
+	}{
+		{"short", 10, true}, {"128", 16, true}, {"full", 0, true}, {"256", 0, false},
+	} {
+		leekBytes = -1
+		e := LeekSetLength(tt.s)
+		if (e == nil) != tt.ok || (tt.ok && leekBytes != tt.bytes) {
+			t.Errorf("%s: %v, %d bytes", tt.s, e, leekBytes)
+		}
+	}
+	fp := make([]byte, 20)
+	for _, tt := range []struct{ bytes, want int }{{10, 10}, {16, 16}, {0, 20}, {32, 20}} {
+		leekBytes = tt.bytes
+		if n := len(leekShown(fp)); n != tt.want {
+			t.Errorf("%d: shows %d bytes, want %d", tt.bytes, n, tt.want)
+		}
+	}
+}
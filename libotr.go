@@ -0,0 +1,237 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/otr"
+)
+
+// libotr keeps otr.fingerprints as tab separated
+// username, accountname, protocol, fingerprint, trust ("verified", "smp" or empty)
+// and otr.private_key as an s-expression of DSA keys per account
+
+func libotrTrust(s string) Trust {
+	switch s {
+	case "":
+		return TrustTofu
+	case "smp":
+		return TrustSmp
+	default: // "verified", and pidgin's older free form trust strings
+		return TrustManual
+	}
+}
+
+// irssi and weechat use nick@server as username, pidgin's irc plugin the bare nick
+func libotrNick(user string) string {
+	if i := strings.Index(user, "@"); i > 0 {
+		user = user[:i]
+	}
+	return strings.ToLower(user)
+}
+
+func libotrAccount() string {
+	host := ircNetwork
+	if len(host) < 1 {
+		host = "localhost"
+	}
+	return myNick + "@" + host
+}
+
+// account, if not empty, picks which of our accounts' fingerprints to take
+func OtrImportFingerprints(name, account string) {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	f, e := os.Open(name)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	defer f.Close()
+	added, skipped := 0, 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 4 || (len(account) > 0 && fields[1] != account) {
+			continue
+		}
+		fp, e := hex.DecodeString(fields[3])
+		if e != nil || len(fp) != 20 {
+			skipped++
+			continue
+		}
+		tr := TrustTofu
+		if len(fields) > 4 {
+			tr = libotrTrust(fields[4])
+		}
+		nick := libotrNick(fields[0])
+		// never downgrade what we already know, revoked sorts last so it stays
+		if old := contactByFingerprint(fp); old != nil && old.Trust >= tr {
+			claimNick(old, nick)
+			skipped++
+			continue
+		}
+		setContact(nick, fp, tr, "imported from "+name)
+		added++
+	}
+	if e := sc.Err(); e != nil {
+		PrintError(e)
+	}
+	PrintLine("OTR: Imported " + strconv.Itoa(added) + " fingerprint(s), kept " + strconv.Itoa(skipped) + " as they were")
+}
+
+func OtrExportFingerprints(name string) {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	var b bytes.Buffer
+	account := libotrAccount()
+	n := 0
+	for k, c := range OTR.Contacts {
+		var tr string
+		switch c.Trust {
+		case TrustRevoked:
+			continue
+		case TrustSmp:
+			tr = "smp"
+		case TrustManual:
+			tr = "verified"
+		}
+		nicks := c.Nicks
+		if OTR.HashKey != nil || len(nicks) < 1 {
+			nicks = []string{k} // no nick to give, the fingerprint will do
+		}
+		for _, nick := range nicks {
+			b.WriteString(nick + "\t" + account + "\tprpl-irc\t" + k + "\t" + tr + "\n")
+			n++
+		}
+	}
+	if e := writeFileAtomic(name, b.Bytes()); e != nil {
+		PrintError(e)
+		return
+	}
+	if OTR.HashKey != nil {
+		PrintLine("OTR: " + ansiColour("Yellow", "Nicks are hashed, exported fingerprints in their place"))
+	}
+	PrintLine("OTR: Exported " + strconv.Itoa(n) + " fingerprint(s) to " + name)
+}
+
+var libotrName = regexp.MustCompile(`\(name\s+"?([^")]*)"?\)`)
+
+// the (account ...) blocks of an otr.private_key
+func libotrAccounts(in []byte) map[string][]byte {
+	accounts := make(map[string][]byte)
+	parts := bytes.Split(in, []byte("(account"))
+	for _, p := range parts[1:] {
+		if m := libotrName.FindSubmatch(p); m != nil {
+			accounts[string(m[1])] = p
+		}
+	}
+	return accounts
+}
+
+// only into the persistent key, an ephemeral one is gone on exit anyway
+func OtrImportKey(name, account string) {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	if !otrKeyPersistent {
+		PrintLine("OTR: No persistent key to import into, start with -otr-key <file>")
+		return
+	}
+	in, e := ioutil.ReadFile(name)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	defer wipe(in)
+	accounts := libotrAccounts(in)
+	var block []byte
+	var names []string
+	for a, b := range accounts {
+		if a == account || len(account) < 1 && len(accounts) == 1 {
+			block = b
+		}
+		names = append(names, a)
+	}
+	if len(accounts) == 0 {
+		block = in // a bare (dsa ...), try it anyway
+	} else if block == nil && len(account) < 1 {
+		sort.Strings(names)
+		PrintLine("OTR: " + name + " holds several keys, pick one of: " + strings.Join(names, ", "))
+		return
+	}
+	key := new(otr.PrivateKey)
+	if block == nil || !key.Import(block) {
+		PrintError(errors.New("OTR: no usable DSA key in " + name))
+		return
+	}
+	old := OTR.key
+	OTR.key = key
+	if e := otrSaveKey(); e != nil {
+		OTR.key = old
+		PrintError(e)
+		return
+	}
+	otrEndAll()
+	PrintLine("OTR: " + ansiColour("Yellow", "Imported key from "+name+", sessions restart with it"))
+	OtrInfo()
+}
+
+// libgcrypt writes MPIs as upper case hex, with a leading 00 if they'd look negative
+func libotrMpi(n *big.Int) string {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func OtrExportKey(name string) {
+	if !otrKeyPersistent {
+		PrintLine("OTR: No persistent key, there is nothing worth exporting")
+		return
+	}
+	k := &OTR.key.PrivateKey
+	s := "(privkeys\n (account\n(name \"" + libotrAccount() + "\")\n(protocol prpl-irc)\n(private-key \n (dsa \n" +
+		"  (p #" + libotrMpi(k.P) + "#)\n" +
+		"  (q #" + libotrMpi(k.Q) + "#)\n" +
+		"  (g #" + libotrMpi(k.G) + "#)\n" +
+		"  (y #" + libotrMpi(k.Y) + "#)\n" +
+		"  (x #" + libotrMpi(k.X) + "#)\n" +
+		"  )\n )\n )\n)\n"
+	if e := writeFileAtomic(name, []byte(s)); e != nil {
+		PrintError(e)
+		return
+	}
+	PrintLine("OTR: " + ansiColour("Yellow", "Exported your private key unencrypted to "+name+", guard it"))
+}
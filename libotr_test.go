@@ -0,0 +1,139 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/otr"
+)
+
+func TestLibotrImportFingerprints(t *testing.T) {
+	testStore(t, false, false)
+	fp := func(b byte) string { return hex.EncodeToString(bytes.Repeat([]byte{b}, 20)) }
+	known, _ := hex.DecodeString(fp(6))
+	setContact("frank", known, TrustSmp, "test")
+	lines := []string{
+		"alice@irc.example\tme@irc.example\tprpl-irc\t" + fp(1) + "\tverified",
+		"Bob\tme@irc.example\tprpl-irc\t" + fp(2) + "\tsmp",
+		"carol\tme@irc.example\tprpl-irc\t" + fp(3),
+		"dave\tme@irc.example\tprpl-irc\t" + fp(4) + "\t",
+		"erin\tme@irc.example\tprpl-irc\tnothex",
+		"erin\tme@irc.example\tprpl-irc\t" + fp(5)[:38],
+		"frank\tme@irc.example\tprpl-irc\t" + fp(6) + "\t", // tofu doesn't downgrade smp
+		"gina\tother@elsewhere\tprpl-irc\t" + fp(7) + "\tverified",
+		"short line",
+	}
+	name := filepath.Join(t.TempDir(), "otr.fingerprints")
+	os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	OtrImportFingerprints(name, "me@irc.example")
+	tests := []struct {
+		nick string
+		want Trust
+		ok   bool
+	}{
+		{"alice", TrustManual, true},
+		{"bob", TrustSmp, true},
+		{"carol", TrustTofu, true},
+		{"dave", TrustTofu, true},
+		{"erin", 0, false},
+		{"frank", TrustSmp, true},
+		{"gina", 0, false}, // another account
+	}
+	for _, tt := range tests {
+		c := contactByNick(tt.nick)
+		if (c != nil) != tt.ok || (c != nil && c.Trust != tt.want) {
+			t.Errorf("%s: got %v, want %v %v", tt.nick, c, tt.ok, tt.want)
+		}
+	}
+
+	// and back out, then in again to an empty store
+	out := filepath.Join(t.TempDir(), "export")
+	OtrExportFingerprints(out)
+	before := len(OTR.Contacts)
+	OTR.Contacts = make(map[string]*Contact)
+	OtrImportFingerprints(out, "")
+	if len(OTR.Contacts) != before {
+		t.Errorf("%d contacts after the round trip, want %d", len(OTR.Contacts), before)
+	}
+	for _, tt := range tests {
+		if c := contactByNick(tt.nick); tt.ok && (c == nil || c.Trust != tt.want) {
+			t.Errorf("%s after the round trip: %v", tt.nick, c)
+		}
+	}
+}
+
+func TestLibotrMpi(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		want string
+	}{
+		{0x7f, "7F"}, {0x80, "0080"}, {0x1234, "1234"}, {0xff00, "00FF00"},
+	} {
+		if got := libotrMpi(big.NewInt(tt.n)); got != tt.want {
+			t.Errorf("%x: %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLibotrKey(t *testing.T) {
+	testStore(t, false, false)
+	dir := t.TempDir()
+	oldFile, oldPersistent := *otrKeyFile, otrKeyPersistent
+	*otrKeyFile, otrKeyPersistent = filepath.Join(dir, "key"), true
+	defer func() { *otrKeyFile, otrKeyPersistent = oldFile, oldPersistent }()
+	keyPass = []byte("correct horse")
+	OTR.key = new(otr.PrivateKey)
+	OTR.key.Generate(rand.Reader)
+	want := OTR.key.PublicKey.Fingerprint()
+
+	one := filepath.Join(dir, "one")
+	OtrExportKey(one)
+	exported, _ := os.ReadFile(one)
+	block := bytes.TrimPrefix(exported, []byte("(privkeys\n"))
+	other := bytes.Replace(block, []byte(libotrAccount()), []byte("other@elsewhere"), 1)
+	two := filepath.Join(dir, "two")
+	os.WriteFile(two, append(append([]byte("(privkeys\n"), block...), other...), 0600)
+
+	tests := []struct {
+		name, file, account string
+		ok                  bool
+	}{
+		{"one account", one, "", true},
+		{"two accounts, none picked", two, "", false},
+		{"two accounts, one picked", two, "other@elsewhere", true},
+		{"garbage", filepath.Join(dir, "key"), "", false}, // our own sealed file
+	}
+	for _, tt := range tests {
+		OTR.key = new(otr.PrivateKey)
+		OTR.key.Generate(rand.Reader)
+		OtrImportKey(tt.file, tt.account)
+		if got := OTR.key.PublicKey.Fingerprint(); bytes.Equal(got, want) != tt.ok {
+			t.Errorf("%s: imported %v, want %v", tt.name, !tt.ok, tt.ok)
+		}
+	}
+	if n := len(libotrAccounts([]byte("(privkeys (account (name \"a@b\") (dsa)) (account (name c@d) (dsa)))"))); n != 2 {
+		t.Errorf("%d accounts, want 2", n)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import "sync"
+
+// everything that touches client state (OTR conversations and contacts,
+// ignores, the current rcpt) runs on this one goroutine, one thing at a
+// time. the terminal and timers only post work to it, and never wait while
+// it's busy: the queue grows instead. the parser is the one thing that can
+// post faster than a person, it waits for room (postLine) so a server that
+// stops reading from us can't have us buffer all it keeps sending.
+const maxLoopQueue = 1024
+
+var (
+	loopLock  sync.Mutex
+	loopQueue []func()
+	loopRoom  = sync.NewCond(&loopLock)
+	loopWake  = make(chan bool, 1)
+	loopDone  = make(chan bool)
+)
+
+func eventLoop() {
+	for range loopWake {
+		loopLock.Lock()
+		fs := loopQueue
+		loopQueue = nil
+		loopRoom.Broadcast()
+		loopLock.Unlock()
+		for _, f := range fs {
+			if f == nil {
+				close(loopDone)
+				return
+			}
+			f()
+			updatePrompt()
+		}
+	}
+}
+
+func post(f func()) {
+	loopLock.Lock()
+	loopQueue = append(loopQueue, f)
+	loopLock.Unlock()
+	loopSignal()
+}
+
+// like post, but waits while maxLoopQueue things are already waiting
+func postLine(f func()) {
+	loopLock.Lock()
+	for len(loopQueue) >= maxLoopQueue {
+		loopRoom.Wait()
+	}
+	loopQueue = append(loopQueue, f)
+	loopLock.Unlock()
+	loopSignal()
+}
+
+func loopSignal() {
+	select {
+	case loopWake <- true:
+	default: // already signalled, the loop will pick this up too
+	}
+}
+
+// finishes everything already posted, nothing runs on the loop afterwards
+func stopLoop() {
+	post(nil)
+	<-loopDone
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func loopQueued() int {
+	loopLock.Lock()
+	defer loopLock.Unlock()
+	return len(loopQueue)
+}
+
+// run with -race: the parser and the terminal post from their own goroutines
+func TestLoopQueueBounded(t *testing.T) {
+	OTR = &OtrConf{conv: make(map[string]*OtrSession), Backend: make(map[string]string)}
+	e2eDefault = otrBackend{}
+	inbox = newMsgQueue(16)
+	go eventLoop()
+
+	release := make(chan bool)
+	started := make(chan bool)
+	post(func() { close(started); <-release }) // stuck, like on send <- to a server that stopped reading
+	<-started
+	const lines = 10 * maxLoopQueue
+	var got []int
+	parsed := make(chan bool)
+	go func() {
+		for i := 0; i < lines; i++ {
+			i := i
+			postLine(func() { got = append(got, i) })
+		}
+		close(parsed)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); loopQueued() < maxLoopQueue; {
+		if time.Now().After(deadline) {
+			t.Fatalf("parser stopped at %d queued, want %d", loopQueued(), maxLoopQueue)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-parsed:
+		t.Fatal("parser queued everything while the loop was stuck")
+	default:
+	}
+	if n := loopQueued(); n != maxLoopQueue {
+		t.Fatalf("%d queued, want at most %d", n, maxLoopQueue)
+	}
+
+	// the terminal still gets through
+	typed := make(chan bool)
+	go func() {
+		post(func() {})
+		close(typed)
+	}()
+	select {
+	case <-typed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("post blocked behind a full queue")
+	}
+
+	close(release)
+	<-parsed
+	stopLoop()
+	if len(got) != lines {
+		t.Fatalf("ran %d of %d", len(got), lines)
+	}
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("ran %d at position %d", v, i)
+		}
+	}
+}
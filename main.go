@@ -18,24 +18,66 @@ package main
 
 import (
 	"flag"
+	"os"
+	"time"
 )
 
 var (
-	IrcServer = flag.String("server", "irc.oftc.net:6697", "IRC Server as host:port")
-	IrcNick   = flag.String("nick", generateNick(), "Nick to use on IRC")
-	ircProxy  = flag.String("proxy", "127.0.0.1:9050", "SOCKS5 proxy as host:port")
-	ircTls    = flag.Bool("tls", true, "use TLS")
-	ircClean  = flag.Bool("clean", true, "Strip join/part/quit/notice")
+	IrcServer     = flag.String("server", "irc.oftc.net:6697", "IRC Server as host:port")
+	IrcNick       = flag.String("nick", generateNick(), "Nick to use on IRC")
+	ircProxy      = flag.String("proxy", "127.0.0.1:9050", "SOCKS5 proxy as host:port")
+	ircTls        = flag.Bool("tls", true, "use TLS")
+	ircClean      = flag.Bool("clean", true, "Strip join/part/quit/notice")
+	ircServers    = flag.String("servers", "", "Failover endpoints as host:port[;tls|plain][;pin=<sha256>][;timeout=<duration>],... (overrides -server)")
+	ircShuffle    = flag.Bool("shuffle", false, "Try failover endpoints in random order")
+	ircTimeout    = flag.Duration("timeout", 60*time.Second, "Default per-endpoint connect timeout")
+	ircCloak      = flag.String("cloak", "", "Expected visible host (glob, e.g. '*.users.example'), warn if it differs")
+	exitIps       = flag.String("exit-ip", "", "Addresses or CIDRs your proxy exits from, any other bare visible address is then a leak")
+	leakQuit      = flag.Bool("leak-quit", false, "Disconnect when the visible host looks like a leak")
+	otrPolicyFlag = flag.String("otr-policy", "manual", "Default OTR policy: manual, opportunistic, require or never")
+	otrEncrypt    = flag.Bool("otr-encrypt", true, "Keep the OTR contact store encrypted with a passphrase")
+	otrHashed     = flag.Bool("otr-hash-nicks", false, "Store contacts under a keyed hash of their nick instead of the nick")
+	downloadDir   = flag.String("download-dir", os.Getenv("HOME")+"/irc-downloads", "Where accepted files are saved")
+	maxFile       = flag.Int64("max-file", 256*1024, "Largest file to send or accept, in bytes")
+	otrEvents     = flag.Bool("otr-events", true, "Keep a journal of OTR security events next to the contact store")
+	leekList      = flag.String("leek", "leek", "Fingerprint words: leek, pgp, easy or a file of 256 or 65536 words, both sides must agree")
+	leekLength    = flag.String("leek-length", "short", "How much of a fingerprint leekspeak covers: short (80 bits), 128 or full")
+	leekChecksum  = flag.Bool("leek-checksum", false, "Add a checksum word to leekspeak fingerprints")
+	leekGroup     = flag.Int("leek-group", 4, "Group leekspeak words in blocks of this many, 0 for no grouping")
+	fpArt         = flag.Bool("fp-art", true, "Draw randomart and colour blocks next to fingerprints")
+	e2eFlag       = flag.String("e2e", "otr", "Default end-to-end backend, /e2e picks one per contact")
+	otrKeyFile    = flag.String("otr-key", "", "Keep a persistent OTR key in this passphrase encrypted file (default is a new key every run)")
 )
 
 func main() {
 	flag.Parse()
-	_, e := Init(*IrcServer, *ircProxy, *ircTls)
+	servers := *ircServers
+	if len(servers) < 1 {
+		servers = *IrcServer
+	}
+	eps, e := ParseEndpoints(servers, *ircTls, *ircTimeout)
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	ircNetwork = eps[0].Network()
+	if leek, e = LoadLeek(*leekList); e != nil {
+		PrintError(e)
+		return
+	}
+	if e := LeekSetLength(*leekLength); e != nil {
+		PrintError(e)
+		return
+	}
+	if e := OtrLoad(); e != nil {
+		PrintError(e)
+		return
+	}
+	_, e = Init(eps, *ircProxy, *ircShuffle)
 	if e != nil {
 		PrintError(e)
 		return
 	}
-	OtrLoad()
 	defer OtrSave()
 	Register(*IrcNick)
 	InitTty()
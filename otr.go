@@ -17,85 +17,129 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
-	"io/ioutil"
+	"errors"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/otr"
 )
 
 type OtrConf struct {
-	key     *otr.PrivateKey
-	Contact map[string][]byte `json:",omitempty"`
-	conv    map[string]*otr.Conversation
+	key      *otr.PrivateKey
+	HashKey  []byte              `json:",omitempty"`
+	Contact  map[string]*Contact `json:",omitempty"` // by nick, only read to migrate
+	Contacts map[string]*Contact `json:",omitempty"` // by hex fingerprint
+	Policy   map[string]Policy   `json:",omitempty"`
+	Secrets  map[string]string   `json:",omitempty"` // pre-agreed SMP secrets
+	Backend  map[string]string   `json:",omitempty"` // e2e backend name, if not the default
+	conv     map[string]*OtrSession
 }
 
+type OtrSession struct {
+	*otr.Conversation
+	blocked    bool     // their key changed, nothing goes out until /otr-accept
+	lockHeld   bool     // blocked only because the store was locked, checked again on unlock
+	held       []string // typed while blocked
+	starting   bool     // AKE requested, not finished yet
+	akeOurs    bool     // and we were the ones asking
+	started    time.Time
+	pending    []string // typed while starting, sent once encrypted
+	warned     bool     // told the user this one goes out in plaintext
+	smp        int
+	smpStarted time.Time
+	smpIgnore  bool // aborted, whatever comes back doesn't count
+	seenOtr    bool // they've sent us something OTR, so they do speak it
+	fragBytes  int  // of a message still being reassembled
+	lastSeen   time.Time
+	lastErr    time.Time
+}
+
+const otrAkeTimeout = 60 * time.Second
+
 var (
 	OTR       *OtrConf
 	otrFile   = os.Getenv("HOME") + "/.otr-fingerprints"
 	otrLoaded = 0
 )
 
-func OtrLoad() {
+func OtrLoad() error {
 	defer OtrInfo()
 	OTR = new(OtrConf)
 	OTR.key = new(otr.PrivateKey)
-	OTR.key.Generate(rand.Reader)
-	OTR.Contact = make(map[string][]byte)
-	OTR.conv = make(map[string]*otr.Conversation)
-	offset := strings.Index(*IrcServer, ":")
-	if offset > 0 {
-		suffix := *IrcServer
-		suffix = "-" + suffix[:offset]
-		otrFile += suffix
-	}
-	conf, e := ioutil.ReadFile(otrFile)
-	if e != nil {
-		PrintError(e)
-		return
+	if len(*otrKeyFile) > 0 {
+		if e := otrLoadKey(*otrKeyFile); e != nil {
+			OTR.key = nil
+			return e
+		}
+	} else {
+		OTR.key.Generate(rand.Reader)
 	}
-	e = json.Unmarshal(conf, OTR)
-	if e != nil {
-		PrintError(e)
-		return
+	if e := otrDefaultPolicy.UnmarshalText([]byte(*otrPolicyFlag)); e != nil {
+		return e
 	}
-}
-
-func OtrSave() {
-	conf, e := json.Marshal(OTR)
-	if e != nil {
-		PrintError(e)
-		return
+	var e error
+	if e2eDefault, e = e2eBackend(*e2eFlag); e != nil {
+		return e
 	}
-	e = ioutil.WriteFile(otrFile, conf, 0600)
-	if e != nil {
-		PrintError(e)
+	OTR.Contacts = make(map[string]*Contact)
+	OTR.Policy = make(map[string]Policy)
+	OTR.Secrets = make(map[string]string)
+	OTR.Backend = make(map[string]string)
+	OTR.conv = make(map[string]*OtrSession)
+	if len(ircNetwork) > 0 {
+		otrFile += "-" + ircNetwork
 	}
+	evFile = otrFile + ".events"
+	return otrLoadStore()
 }
 
-func OtrNew() *otr.Conversation {
+func OtrNew() *OtrSession {
 	conv := new(otr.Conversation)
 	conv.PrivateKey = OTR.key
 	conv.FragmentSize = 400
-	return conv
+	return &OtrSession{Conversation: conv}
 }
 
 func OtrStart(rcpt string) {
 	rcpt = strings.ToLower(rcpt)
+	if otrPolicy(rcpt) == PolicyNever {
+		PrintLine("OTR: Policy for " + rcpt + " is never, '/otr-policy " + rcpt + " manual' to change it")
+		return
+	}
 	if _, ok := OTR.conv[rcpt]; ok == false {
 		OTR.conv[rcpt] = OtrNew()
 	}
+	sess := OTR.conv[rcpt]
+	delete(otrNoSupport, rcpt)
+	otrAkeBegin(sess, true)
 	send <- "PRIVMSG " + rcpt + " :" + otr.QueryMessage
 }
 
+// from here until NewKeys whatever is typed waits in pending
+func otrAkeBegin(sess *OtrSession, ours bool) {
+	started := time.Now()
+	sess.starting = true
+	sess.akeOurs = ours
+	sess.started = started
+	time.AfterFunc(otrAkeTimeout, func() {
+		post(func() { otrAkeTimedOut(sess, started) })
+	})
+}
+
 func OtrEnd(rcpt string) {
 	rcpt = strings.ToLower(rcpt)
 	if _, ok := OTR.conv[rcpt]; ok {
+		if held := OtrPending(rcpt); held > 0 {
+			PrintLine("OTR: Dropped " + strconv.Itoa(held) + " held message(s) to " + rcpt)
+		}
+		if OTR.conv[rcpt].IsEncrypted() {
+			otrLog(rcpt, "ended", "by us")
+		}
 		msgs := OTR.conv[rcpt].End()
 		for _, msg := range msgs {
 			send <- "PRIVMSG " + rcpt + " :" + string(msg)
@@ -104,11 +148,59 @@ func OtrEnd(rcpt string) {
 	}
 }
 
+// by session rather than nick, they may have changed nick since
+func otrAkeTimedOut(sess *OtrSession, started time.Time) {
+	for rcpt, s := range OTR.conv {
+		if s == sess && sess.starting && sess.started.Equal(started) {
+			otrAkeFailed(rcpt, "timed out")
+			if !sess.seenOtr {
+				otrNoOtr(rcpt)
+			}
+		}
+	}
+}
+
+func otrAkeFailed(rcpt, why string) {
+	sess := OTR.conv[rcpt]
+	sess.starting = false
+	PrintLine("OTR: Key exchange with " + rcpt + " " + ansiColour("Red", why))
+	otrLog(rcpt, "ake-failed", why)
+	if n := len(sess.pending); n > 0 {
+		PrintLine("OTR: Dropped " + strconv.Itoa(n) + " queued message(s) to " + rcpt)
+		sess.pending = nil
+	}
+}
+
+func otrFlushPending(rcpt string) {
+	sess := OTR.conv[rcpt]
+	pending := sess.pending
+	sess.pending = nil
+	for _, msg := range pending {
+		OtrSend(rcpt, msg)
+	}
+}
+
+// queued or held, waiting to go out
+func OtrPending(rcpt string) int {
+	if sess, ok := OTR.conv[strings.ToLower(rcpt)]; ok {
+		return len(sess.pending) + len(sess.held)
+	}
+	return 0
+}
+
 func OtrStatus(rcpt string) {
+	policy := " (policy " + otrPolicy(rcpt).String()
+	if sess, ok := OTR.conv[strings.ToLower(rcpt)]; ok && sess.smp != smpIdle {
+		policy += ", SMP " + smpStates[sess.smp]
+	}
+	policy += ")"
+	if n := otrRecentKeys(strings.ToLower(rcpt)); n > 1 {
+		policy += ", " + strconv.Itoa(n) + " clients, see /otr-instances"
+	}
 	if OtrIsEncrypted(rcpt) {
-		PrintLine("OTR: " + ansiColour("Green", "Encrypted with "+rcpt))
+		PrintLine("OTR: " + ansiColour("Green", "Encrypted with "+rcpt) + policy)
 	} else {
-		PrintLine("OTR: " + ansiColour("Red", "Unencrypted with "+rcpt))
+		PrintLine("OTR: " + ansiColour("Red", "Unencrypted with "+rcpt) + policy)
 	}
 }
 
@@ -123,7 +215,7 @@ func fingerprint(d []byte, prehashed bool) string {
 		frag = append(frag, f)
 	}
 	hexfp := strings.Join(frag, ":")
-	leekfp := leek.Encode(d[:10])
+	leekfp := LeekFingerprint(d)
 	fp := "[" + hexfp + "](" + leekfp + ")"
 	return fp
 }
@@ -132,23 +224,158 @@ func OtrFingerprint(rcpt string) {
 	rcpt = strings.ToLower(rcpt)
 	current := OTR.conv[rcpt].TheirPublicKey.Fingerprint()
 	fpstring := fingerprint(current, true)
-	if stored, ok := OTR.Contact[rcpt]; ok {
-		if bytes.Equal(stored, current) {
-			PrintLine("OTR: Contact " + rcpt + " has good fingerprint: " + ansiColour("Green", fpstring))
-		} else {
-			PrintLine("OTR: Contact " + rcpt + " has bad fingerprint: " + ansiColour("Red", fpstring))
-
-		}
-	} else {
+	otrSeenInstance(rcpt, current, 0)
+	if otrLocked {
+		// can't tell a key change from a known key, so hold everything until we can
+		OTR.conv[rcpt].blocked = true
+		OTR.conv[rcpt].lockHeld = true
+		PrintLine("OTR: Contact " + rcpt + " has fingerprint " + ansiColour("Yellow", fpstring) + ", contact store is locked so it can't be checked. Sending is blocked until /otr-unlock.")
+		return
+	}
+	known := contactByFingerprint(current)
+	previous := contactByNick(rcpt)
+	switch {
+	case known != nil && known.Trust == TrustRevoked:
+		OTR.conv[rcpt].blocked = true
+		PrintLine("OTR: Contact " + rcpt + " has revoked fingerprint: " + ansiColour("Red", fpstring) + ". Sending is blocked.")
+		PrintLine("OTR: '/otr-accept " + rcpt + "' to trust it again or '/otr-end " + rcpt + "'.")
+		otrLog(rcpt, "key-revoked", "session with a revoked key")
+	case known != nil && previous != nil && previous != known:
+		// a key we know, but not the one this nick had: no quiet takeover, however trusted
+		OTR.conv[rcpt].blocked = true
+		otrLog(rcpt, "key-changed", "was "+hex.EncodeToString(previous.Fingerprint)+", now a less trusted known key")
+		PrintLine("OTR: " + ansiColour("Red", "Contact "+rcpt+" switched from a "+previous.Trust.String()+" key to a "+known.Trust.String()+" one. Sending is blocked."))
+		PrintLine("OTR: Stored " + previous.String() + ": " + ansiColour("Yellow", fingerprint(previous.Fingerprint, true)))
+		PrintLine("OTR: Current " + known.String() + ": " + ansiColour("Red", fpstring))
+		PrintArt("OTR: ", fingerprintArt(previous.Fingerprint, true, "stored"), fingerprintArt(current, true, "current"))
+		PrintLine("OTR: Verify with '/otr-smpq " + rcpt + " <question>? <answer>', then '/otr-accept " + rcpt + "' or '/otr-end " + rcpt + "'.")
+	case known != nil:
+		claimNick(known, rcpt)
+		otrLog(rcpt, "started", known.Trust.String())
+		PrintLine("OTR: Contact " + rcpt + " has good fingerprint: " + ansiColour(known.Trust.Colour(), fpstring) + " " + known.String())
+	case previous != nil:
+		OTR.conv[rcpt].blocked = true
+		otrLog(rcpt, "key-changed", "was "+hex.EncodeToString(previous.Fingerprint))
+		PrintLine("OTR: " + ansiColour("Red", "Contact "+rcpt+" has a NEW fingerprint, this may be a MITM. Sending is blocked."))
+		PrintLine("OTR: Stored " + previous.String() + ": " + ansiColour("Yellow", fingerprint(previous.Fingerprint, true)))
+		PrintLine("OTR: Current: " + ansiColour("Red", fpstring))
+		PrintArt("OTR: ", fingerprintArt(previous.Fingerprint, true, "stored"), fingerprintArt(current, true, "current"))
+		PrintLine("OTR: Verify with '/otr-smpq " + rcpt + " <question>? <answer>', then '/otr-accept " + rcpt + "' or '/otr-end " + rcpt + "'.")
+	default:
 		// hey I just met you
 		// and this is crazy
 		// but i trust-on-first-use
 		// so call me 9d4737bf104973dfc3ad21019e243406c6a55c33
-		OTR.Contact[rcpt] = current
+		setContact(rcpt, current, TrustTofu, "first seen")
+		otrLog(rcpt, "key-new", "first seen")
 		PrintLine("OTR: Contact " + rcpt + " has unknown fingerprint: " + ansiColour("Yellow", fpstring))
 	}
 }
 
+// what /otr-info shows for a live session, it checks and logs nothing
+func otrShowFingerprint(rcpt string) {
+	current := theirFingerprint(rcpt)
+	fpstring := fingerprint(current, true)
+	c := contactByFingerprint(current)
+	switch {
+	case otrLocked:
+		PrintLine("OTR: Contact " + rcpt + " has fingerprint " + ansiColour("Yellow", fpstring) + ", contact store is locked")
+	case c != nil:
+		PrintLine("OTR: Contact " + rcpt + " has fingerprint " + ansiColour(c.Trust.Colour(), fpstring) + " " + c.String())
+	default:
+		PrintLine("OTR: Contact " + rcpt + " has unknown fingerprint " + ansiColour("Yellow", fpstring))
+	}
+	if OTR.conv[rcpt].blocked {
+		PrintLine("OTR: " + ansiColour("Red", "Sending to "+rcpt+" is blocked"))
+	}
+	PrintArt("OTR: ", fingerprintArt(current, true, rcpt))
+}
+
+// sessions that came up while the store was locked, now their keys can be checked
+func otrRecheckLocked() {
+	for rcpt, sess := range OTR.conv {
+		if !sess.lockHeld {
+			continue
+		}
+		sess.lockHeld = false
+		sess.blocked = false
+		if sess.IsEncrypted() {
+			OtrFingerprint(rcpt)
+		}
+		if !sess.blocked {
+			otrUnblock(rcpt)
+		}
+	}
+}
+
+func otrUnblock(rcpt string) {
+	sess := OTR.conv[rcpt]
+	held := sess.held
+	sess.blocked = false
+	sess.lockHeld = false
+	sess.held = nil
+	PrintLine("OTR: " + ansiColour("Green", "Unblocked "+rcpt) + ", sending " + strconv.Itoa(len(held)) + " held message(s)")
+	for _, msg := range held {
+		OtrSend(rcpt, msg)
+	}
+}
+
+// take the changed key as theirs, as if first seen unless SMP already vouched for it
+func OtrAccept(rcpt string) {
+	rcpt = strings.ToLower(rcpt)
+	sess, ok := OTR.conv[rcpt]
+	if !ok || !sess.blocked {
+		PrintLine("OTR: Nothing to accept for " + rcpt)
+		return
+	}
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	fp := sess.TheirPublicKey.Fingerprint()
+	if c := contactByFingerprint(fp); c != nil && c.Trust != TrustRevoked {
+		claimNick(c, rcpt) // keeps whatever trust that key earned itself
+	} else {
+		setContact(rcpt, fp, TrustTofu, "accepted key change")
+	}
+	otrLog(rcpt, "key-accepted", "")
+	otrUnblock(rcpt)
+}
+
+// the session, policy and the key's nick follow them to their new nick
+func OtrNick(from, to string) {
+	from = strings.ToLower(from)
+	to = strings.ToLower(to)
+	if from == to {
+		return
+	}
+	if p, ok := OTR.Policy[contactKey(from)]; ok {
+		OTR.Policy[contactKey(to)] = p
+		delete(OTR.Policy, contactKey(from))
+	}
+	if secret, ok := OTR.Secrets[contactKey(from)]; ok {
+		OTR.Secrets[contactKey(to)] = secret
+		delete(OTR.Secrets, contactKey(from))
+	}
+	if otrNoSupport[from] {
+		otrNoSupport[to] = true
+		delete(otrNoSupport, from)
+	}
+	otrInstancesNick(from, to)
+	sess, ok := OTR.conv[from]
+	if !ok {
+		return
+	}
+	OTR.conv[to] = sess
+	delete(OTR.conv, from)
+	if fp := theirFingerprint(to); fp != nil && !otrLocked {
+		if c := contactByFingerprint(fp); c != nil {
+			claimNick(c, to)
+		}
+	}
+	PrintLine("OTR: Session with " + from + " follows them to " + to)
+}
+
 func OtrIsEncrypted(nick string) bool {
 	nick = strings.ToLower(nick)
 	if c, ok := OTR.conv[nick]; ok {
@@ -160,89 +387,259 @@ func OtrIsEncrypted(nick string) bool {
 
 func OtrInfo() {
 	if OTR.key != nil {
+		kind := "ephemeral"
+		if otrKeyPersistent {
+			kind = "persistent"
+		}
 		fpstring := fingerprint(OTR.key.PublicKey.Fingerprint(), true)
-		PrintLine("OTR: " + ansiColour("Green", "Loaded with fingerprint: "+fpstring))
+		PrintLine("OTR: " + ansiColour("Green", "Loaded "+kind+" key with fingerprint: "+fpstring))
+		PrintArt("OTR: ", fingerprintArt(OTR.key.PublicKey.Fingerprint(), true, "OTR you"))
 	} else {
 		PrintLine("OTR: " + ansiColour("Red", "Not loaded"))
 		return
 	}
 	for r := range OTR.conv {
 		if OtrIsEncrypted(r) {
-			OtrFingerprint(r)
+			otrShowFingerprint(r)
 		} else {
 			PrintLine("OTR: Contact " + r + " is currently " + ansiColour("Red", "unencrypted"))
 		}
 	}
 }
 
-func OtrSmpQuestion(rcpt, quest, resp string) {
+// client to client CTCP-style lines, only ever over an encrypted session
+func otrControl(rcpt string, args ...string) bool {
 	rcpt = strings.ToLower(rcpt)
-	if _, ok := OTR.conv[rcpt]; ok == false {
-		OTR.conv[rcpt] = OtrNew()
+	sess, ok := OTR.conv[rcpt]
+	if !ok || !sess.IsEncrypted() || sess.blocked {
+		return false
 	}
-	msgs, e := OTR.conv[rcpt].Authenticate(quest, []byte(resp))
+	outs, e := sess.Send([]byte("\x01" + strings.Join(args, " ") + "\x01"))
 	if e != nil {
 		PrintError(e)
-		return
+		return false
 	}
-	for _, msg := range msgs {
-		send <- "PRIVMSG " + rcpt + " :" + string(msg)
+	for _, out := range outs {
+		send <- "PRIVMSG " + rcpt + " :" + string(out)
 	}
+	return true
 }
 
-func OtrSmpResp(rcpt, resp string) {
-	rcpt = strings.ToLower(rcpt)
-	if _, ok := OTR.conv[rcpt]; ok == false {
-		OTR.conv[rcpt] = OtrNew()
+// a bot spamming queries shouldn't fill the journal, one refusal a nick a minute
+var otrRefused = make(map[string]time.Time)
+
+func otrRefuseLogged(nick string) bool {
+	now := time.Now()
+	if now.Sub(otrRefused[nick]) < time.Minute {
+		return false
 	}
-	smpq := OTR.conv[rcpt].SMPQuestion()
-	msgs, e := OTR.conv[rcpt].Authenticate(smpq, []byte(resp))
-	if e != nil {
-		PrintError(e)
+	if len(otrRefused) >= maxOtrSessions {
+		for k, t := range otrRefused {
+			if now.Sub(t) >= time.Minute {
+				delete(otrRefused, k)
+			}
+		}
+	}
+	otrRefused[nick] = now
+	return true
+}
+
+const (
+	maxOtrFragments = 64         // reassembly buffers at most this many lines per message
+	maxOtrFragBytes = 256 * 1024 // and this much for all sessions together
+	maxOtrSessions  = 256        // sessions that never got anywhere are dropped beyond this
+)
+
+func otrFragmentTooLarge(in string) bool {
+	if !strings.HasPrefix(in, "?OTR,") {
+		return false
+	}
+	parts := strings.SplitN(in[len("?OTR,"):], ",", 3)
+	if len(parts) < 3 {
+		return false // the library rejects it itself
+	}
+	n, e := strconv.Atoi(parts[1])
+	return e == nil && n > maxOtrFragments
+}
+
+// partly reassembled messages stay under maxOtrFragBytes, the oldest give way
+func otrFragmentAdmit(sess *OtrSession, in string) {
+	if !strings.HasPrefix(in, "?OTR,") {
 		return
 	}
-	for _, msg := range msgs {
-		send <- "PRIVMSG " + rcpt + " :" + string(msg)
+	parts := strings.SplitN(in[len("?OTR,"):], ",", 3)
+	if len(parts) < 3 {
+		return
+	}
+	if parts[0] == "1" {
+		sess.fragBytes = 0
+	}
+	for {
+		var total int
+		var oldest *OtrSession
+		for _, s := range OTR.conv {
+			total += s.fragBytes
+			if s.fragBytes > 0 && (oldest == nil || s.lastSeen.Before(oldest.lastSeen)) {
+				oldest = s
+			}
+		}
+		if total+len(in) <= maxOtrFragBytes || oldest == nil {
+			break
+		}
+		// a first fragment of two, empty, makes the library drop what it had
+		oldest.Receive([]byte("?OTR,1,2,,"))
+		oldest.fragBytes = 0
+	}
+	sess.fragBytes += len(in)
+	if parts[0] == parts[1] {
+		sess.fragBytes = 0 // complete, the library hands it over now
+	}
+}
+
+// sessions that are only a query or a stray fragment, least recently heard from first
+func otrTrimSessions() {
+	for len(OTR.conv) >= maxOtrSessions {
+		var oldest string
+		for rcpt, s := range OTR.conv {
+			if s.IsEncrypted() || s.starting || s.blocked || len(s.pending) > 0 {
+				continue
+			}
+			if len(oldest) < 1 || s.lastSeen.Before(OTR.conv[oldest].lastSeen) {
+				oldest = rcpt
+			}
+		}
+		if len(oldest) < 1 {
+			return
+		}
+		delete(OTR.conv, oldest)
 	}
 }
 
 func OtrRecv(m *Msg) {
+	if len(m.nick) < 1 {
+		return
+	}
+	if otrFragmentTooLarge(m.content) {
+		PrintError(errors.New("OTR: dropped oversized fragmented message from " + m.nick))
+		m.content = ""
+		return
+	}
 	otrnick := strings.ToLower(m.nick)
+	policy := otrPolicy(otrnick)
+	if policy == PolicyNever {
+		if strings.HasPrefix(m.content, "?OTR") && otrRefuseLogged(otrnick) {
+			otrLog(otrnick, "refused", "OTR from them (policy never)")
+		}
+		return
+	}
 	if _, ok := OTR.conv[otrnick]; ok == false {
+		otrTrimSessions()
 		OTR.conv[otrnick] = OtrNew()
 	}
+	OTR.conv[otrnick].lastSeen = time.Now()
+	otrFragmentAdmit(OTR.conv[otrnick], m.content)
+	if strings.HasPrefix(m.content, "?OTR") {
+		OTR.conv[otrnick].seenOtr = true
+		delete(otrNoSupport, otrnick)
+		if tag, ok := otrInstanceTag(m.content); ok {
+			otrSeenInstance(otrnick, nil, tag)
+		}
+	}
+	if strings.HasPrefix(m.content, otrErrorPrefix) {
+		otrPeerError(otrnick, m.content)
+		m.content = ""
+		return
+	}
 	recv, enc, chg, msgs, e := OTR.conv[otrnick].Receive([]byte(m.content))
 	if e != nil {
-		PrintError(e)
+		otrRecvError(otrnick, e)
+		m.content = ""
 		return
 	}
+	if !enc {
+		var tagged bool
+		if recv, tagged = stripWhitespaceTagBytes(recv); tagged && !OTR.conv[otrnick].IsEncrypted() {
+			if policy == PolicyOpportunistic || policy == PolicyRequire {
+				PrintLine("OTR: " + m.nick + " supports OTR, starting a session")
+				otrAutoStart(otrnick)
+			} else {
+				PrintLine("OTR: " + m.nick + " supports OTR, '/otr-start " + m.nick + "' to use it")
+			}
+		}
+	}
+	sess := OTR.conv[otrnick]
+	if len(msgs) > 0 && !sess.IsEncrypted() && !sess.starting {
+		otrAkeBegin(sess, false) // they started it, hold our lines all the same
+	}
+	initiated := sess.starting && sess.akeOurs
 	switch {
 	case chg == otr.NewKeys:
+		OTR.conv[otrnick].starting = false
 		OtrFingerprint(otrnick)
-	case chg == otr.SMPSecretNeeded:
-		smpq := OTR.conv[otrnick].SMPQuestion()
-		PrintLine("OTR: " + m.nick + " asks '" + smpq + "'. Type '/otr-smpr " + m.nick + " <response>' to answer.")
-	case chg == otr.SMPComplete:
-		PrintLine("OTR: " + m.nick + " " + ansiColour("Green", "completed") + " authentication.")
-		OTR.Contact[otrnick] = OTR.conv[otrnick].TheirPublicKey.Fingerprint()
-	case chg == otr.SMPFailed:
-		PrintLine("OTR: " + m.nick + " " + ansiColour("Red", "failed") + " authentication.")
+	case chg == otr.SMPSecretNeeded || chg == otr.SMPComplete || chg == otr.SMPFailed:
+		otrSmpChange(otrnick, chg)
 	case chg == otr.ConversationEnded:
 		PrintLine("OTR: Ended with " + ansiColour("Red", m.nick))
+		otrLog(otrnick, "ended", "by them")
+		if OTR.conv[otrnick].starting {
+			otrAkeFailed(otrnick, "was ended")
+		}
 	}
 	m.enc = enc
 	m.content = string(recv)
 	for _, msg := range msgs {
 		send <- "PRIVMSG " + m.nick + " :" + string(msg)
 	}
-	updateTerm()
+	// only after our last AKE message, or they can't read these
+	if chg == otr.NewKeys {
+		otrFlushPending(otrnick)
+		otrSmpAuto(otrnick, initiated)
+	}
 }
 
 func OtrSend(rcpt, msg string) {
 	rcpt = strings.ToLower(rcpt)
+	policy := otrPolicy(rcpt)
+	if policy == PolicyNever {
+		send <- "PRIVMSG " + rcpt + " :" + msg
+		return
+	}
 	if _, ok := OTR.conv[rcpt]; ok == false {
 		OTR.conv[rcpt] = OtrNew()
 	}
+	sess := OTR.conv[rcpt]
+	if !sess.IsEncrypted() && !sess.blocked {
+		if policy == PolicyRequire && !sess.starting {
+			otrLog(rcpt, "refused", "plaintext to them (policy require)")
+			if !otrAutoStart(rcpt) {
+				PrintLine("OTR: " + ansiColour("Red", "Not sent, "+rcpt+" doesn't seem to support OTR") + " (policy require), '/otr-start " + rcpt + "' to try again")
+				return
+			}
+			PrintLine("OTR: " + ansiColour("Red", "Not sending plaintext to "+rcpt) + " (policy require), starting OTR")
+		}
+		if sess.starting {
+			sess.pending = append(sess.pending, msg)
+			PrintLine("OTR: Queued until the key exchange with " + rcpt + " finishes (" + strconv.Itoa(len(sess.pending)) + " pending)")
+			return
+		}
+		switch policy {
+		case PolicyOpportunistic:
+			if !otrNoSupport[rcpt] {
+				msg += otrWhitespaceTag
+			}
+			fallthrough
+		default:
+			if !sess.warned {
+				sess.warned = true
+				PrintLine("OTR: " + ansiColour("Red", "Sending to "+rcpt+" unencrypted") + " (policy " + policy.String() + ")")
+			}
+		}
+	}
+	if OTR.conv[rcpt].blocked {
+		OTR.conv[rcpt].held = append(OTR.conv[rcpt].held, msg)
+		PrintLine("OTR: " + ansiColour("Red", "Held, "+rcpt+"'s key changed.") + " '/otr-accept " + rcpt + "' sends it, '/otr-end " + rcpt + "' drops it.")
+		return
+	}
 	outs, e := OTR.conv[rcpt].Send([]byte(msg))
 	if e != nil {
 		PrintError(e)
@@ -251,5 +648,4 @@ func OtrSend(rcpt, msg string) {
 	for _, out := range outs {
 		send <- "PRIVMSG " + rcpt + " :" + string(out)
 	}
-	updateTerm()
 }
@@ -0,0 +1,79 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/otr"
+)
+
+// a nick whose session comes up with a key other than its own is held,
+// however much that other key is trusted
+func TestOtrKeyTakeover(t *testing.T) {
+	var alice, bob otr.PrivateKey
+	alice.Generate(rand.Reader)
+	bob.Generate(rand.Reader)
+	none := Trust(-1)
+	tests := []struct {
+		name             string
+		stored, presents Trust // alice's contact and the key the session shows, none for no contact
+		bobs             bool  // the session shows bob's key rather than alice's
+		blocked          bool
+	}{
+		{"own key", TrustSmp, TrustSmp, false, false},
+		{"own key, tofu", TrustTofu, TrustTofu, false, false},
+		{"first seen", none, none, false, false},
+		{"new key", TrustSmp, none, true, true},
+		{"less trusted known key", TrustSmp, TrustTofu, true, true},
+		{"equally trusted known key", TrustSmp, TrustSmp, true, true},
+		{"more trusted known key", TrustTofu, TrustManual, true, true},
+		{"revoked own key", TrustRevoked, TrustRevoked, false, true},
+		{"revoked other key", none, TrustRevoked, true, true},
+	}
+	for _, tt := range tests {
+		testStore(t, false, false)
+		if tt.stored != none {
+			setContact("alice", alice.PublicKey.Fingerprint(), tt.stored, "test")
+		}
+		if tt.bobs && tt.presents != none {
+			setContact("bob", bob.PublicKey.Fingerprint(), tt.presents, "test")
+		}
+		sess := OtrNew()
+		sess.TheirPublicKey = alice.PublicKey
+		if tt.bobs {
+			sess.TheirPublicKey = bob.PublicKey
+		}
+		OTR.conv["alice"] = sess
+		OtrFingerprint("alice")
+		if sess.blocked != tt.blocked {
+			t.Errorf("%s: blocked %v, want %v", tt.name, sess.blocked, tt.blocked)
+		}
+		if c := contactByNick("alice"); tt.blocked && tt.stored != none && (c == nil || c.Trust != tt.stored) {
+			t.Errorf("%s: alice's nick moved to another key before /otr-accept", tt.name)
+		}
+	}
+}
+
+func TestNickChange(t *testing.T) {
+	for _, line := range []string{":alice!a@h NICK :carol", ":alice!a@h NICK carol"} {
+		if got := Parse(line).newNick(); got != "carol" {
+			t.Errorf("%q: new nick %q", line, got)
+		}
+	}
+}
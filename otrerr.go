@@ -0,0 +1,125 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// what the x/crypto/otr errors mean for the user, by their text since the
+// library doesn't export them
+const (
+	otrErrUnreadable = iota // a data message we have no keys for, one side lost state
+	otrErrMalformed         // garbage, or a version we don't speak
+	otrErrAke               // the key exchange itself went wrong
+	otrErrSmp               // an SMP message didn't check out, that run is over
+)
+
+const (
+	otrErrorPrefix = "?OTR Error:"
+	otrErrorRate   = 10 * time.Second // at most one ?OTR Error: back per nick in this long
+)
+
+// nicks that never answered a query, automatic queries skip them until /otr-start
+var otrNoSupport = make(map[string]bool)
+
+func otrErrorKind(e error) int {
+	s := e.Error()
+	if strings.Contains(s, "SMP") {
+		return otrErrSmp
+	}
+	for _, u := range []string{"without encrypted session", "bad MAC", "counter regressed", "requested keyid", "corrupt data message", "corrupt tlv"} {
+		if strings.Contains(s, u) {
+			return otrErrUnreadable
+		}
+	}
+	for _, m := range []string{"fragment", "base64", "invalid OTR message", "unknown message type"} {
+		if strings.Contains(s, m) {
+			return otrErrMalformed
+		}
+	}
+	return otrErrAke
+}
+
+func otrRecvError(rcpt string, e error) {
+	sess := OTR.conv[rcpt]
+	why := strings.TrimPrefix(e.Error(), "otr: ")
+	switch otrErrorKind(e) {
+	case otrErrUnreadable:
+		PrintLine("OTR: " + ansiColour("Red", "Couldn't decrypt a message from "+rcpt) + " (" + why + ")")
+		otrLog(rcpt, "unreadable", why)
+		if time.Since(sess.lastErr) > otrErrorRate {
+			sess.lastErr = time.Now()
+			send <- "PRIVMSG " + rcpt + " :" + otrErrorPrefix + " You transmitted an unreadable encrypted message."
+		}
+		otrReinit(rcpt)
+	case otrErrMalformed:
+		PrintLine("OTR: " + ansiColour("Red", "Dropped a malformed OTR message from "+rcpt) + " (" + why + ")")
+	case otrErrSmp:
+		PrintLine("OTR: SMP with " + rcpt + " " + ansiColour("Red", "failed") + " (" + why + "), '/otr-smpq " + rcpt + "' to try again")
+		otrLog(rcpt, "smp-failed", why)
+		sess.smp = smpIdle
+		sess.smpIgnore = false
+	default:
+		PrintLine("OTR: " + ansiColour("Red", "Key exchange error with "+rcpt) + " (" + why + ")")
+		if sess.starting {
+			otrAkeFailed(rcpt, "failed")
+		}
+	}
+}
+
+// an ?OTR Error: from them, usually because they lost the session
+func otrPeerError(rcpt, msg string) {
+	msg = strings.TrimSpace(strings.TrimPrefix(msg, otrErrorPrefix))
+	PrintLine("OTR: " + ansiColour("Red", rcpt+" reports an error:") + " " + msg)
+	otrLog(rcpt, "peer-error", msg)
+	sess := OTR.conv[rcpt]
+	if sess.IsEncrypted() {
+		PrintLine("OTR: What you last sent " + rcpt + " probably wasn't read, send it again once the new session is up")
+		otrReinit(rcpt)
+	}
+}
+
+// start over if policy lets us and we aren't already
+func otrReinit(rcpt string) {
+	if otrPolicy(rcpt) == PolicyNever || OTR.conv[rcpt].starting {
+		return
+	}
+	if otrAutoStart(rcpt) {
+		PrintLine("OTR: Restarting the session with " + rcpt)
+	}
+}
+
+// OtrStart unless rcpt is known not to speak OTR, the user can still /otr-start
+func otrAutoStart(rcpt string) bool {
+	if otrNoSupport[strings.ToLower(rcpt)] {
+		return false
+	}
+	OtrStart(rcpt)
+	return true
+}
+
+// the AKE timed out without a single OTR message from them
+func otrNoOtr(rcpt string) {
+	if otrNoSupport[rcpt] {
+		return
+	}
+	otrNoSupport[rcpt] = true
+	PrintLine("OTR: " + ansiColour("Yellow", rcpt+" doesn't seem to support OTR") + ", no more automatic queries ('/otr-start " + rcpt + "' to try anyway)")
+	otrLog(rcpt, "no-otr", "no answer to query")
+}
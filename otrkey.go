@@ -0,0 +1,118 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/otr"
+)
+
+var otrKeyPersistent = false
+
+func otrLoadKey(name string) error {
+	sealed, e := ioutil.ReadFile(name)
+	if os.IsNotExist(e) {
+		PrintLine("OTR: Creating persistent key " + name)
+		pass, e := readPassphrase("New passphrase for OTR key: ", true)
+		if e != nil {
+			return e
+		}
+		keyPass = pass
+		otrKeyPersistent = true
+		OTR.key.Generate(rand.Reader)
+		return otrSaveKey()
+	} else if e != nil {
+		return e
+	}
+	pass, e := readPassphrase("Passphrase for OTR key "+name+": ", false)
+	if e != nil {
+		return e
+	}
+	plain, e := VaultOpen(pass, sealed)
+	if e != nil {
+		return e
+	}
+	defer wipe(plain)
+	if _, ok := OTR.key.Parse(plain); !ok {
+		return errors.New("OTR: key file " + name + " does not hold a key")
+	}
+	keyPass = pass
+	otrKeyPersistent = true
+	return nil
+}
+
+func otrSaveKey() error {
+	if keyPass == nil {
+		return errors.New("OTR: the key's passphrase was wiped by /otr-lock, restart to rotate")
+	}
+	plain := OTR.key.Serialize(nil)
+	defer wipe(plain)
+	sealed, e := VaultSeal(keyPass, plain)
+	if e != nil {
+		return e
+	}
+	return writeFileAtomic(*otrKeyFile, sealed)
+}
+
+func otrEndAll() {
+	for rcpt := range OTR.conv {
+		OtrEnd(rcpt)
+	}
+}
+
+func OtrRotateKey() {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	if !otrKeyPersistent {
+		PrintLine("OTR: No persistent key, the ephemeral one is new every run")
+		return
+	}
+	old := OTR.key
+	OTR.key = new(otr.PrivateKey)
+	OTR.key.Generate(rand.Reader)
+	if e := otrSaveKey(); e != nil {
+		OTR.key = old
+		PrintError(e)
+		return
+	}
+	otrEndAll()
+	PrintLine("OTR: " + ansiColour("Yellow", "Rotated key, contacts will see a new fingerprint"))
+	OtrInfo()
+}
+
+func OtrDestroyKey() {
+	if !otrKeyPersistent {
+		PrintLine("OTR: No persistent key to destroy")
+		return
+	}
+	if e := shredFile(*otrKeyFile); e != nil {
+		PrintError(e)
+		return
+	}
+	otrKeyPersistent = false
+	OTR.key = new(otr.PrivateKey)
+	OTR.key.Generate(rand.Reader)
+	otrEndAll()
+	PrintLine("OTR: " + ansiColour("Yellow", "Destroyed "+*otrKeyFile+", using an ephemeral key from now on"))
+	OtrInfo()
+}
@@ -0,0 +1,284 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var otrLocked = false
+
+// with a HashKey the store never names who we talk to, only HMAC(nick)
+func contactKey(nick string) string {
+	nick = strings.ToLower(nick)
+	if OTR.HashKey == nil {
+		return nick
+	}
+	mac := hmac.New(sha256.New, OTR.HashKey)
+	mac.Write([]byte(nick))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func otrHashNicks() error {
+	OTR.HashKey = make([]byte, 32)
+	if _, e := io.ReadFull(rand.Reader, OTR.HashKey); e != nil {
+		OTR.HashKey = nil
+		return e
+	}
+	for _, c := range OTR.Contacts {
+		for i, nick := range c.Nicks {
+			c.Nicks[i] = contactKey(nick)
+		}
+	}
+	policies := make(map[string]Policy)
+	for nick, p := range OTR.Policy {
+		policies[contactKey(nick)] = p
+	}
+	OTR.Policy = policies
+	secrets := make(map[string]string)
+	for nick, secret := range OTR.Secrets {
+		secrets[contactKey(nick)] = secret
+	}
+	OTR.Secrets = secrets
+	chosen := make(map[string]string)
+	for nick, b := range OTR.Backend {
+		chosen[contactKey(nick)] = b
+	}
+	OTR.Backend = chosen
+	return nil
+}
+
+func otrStorePass(confirm bool) error {
+	if storePass != nil {
+		return nil
+	}
+	prompt := "Passphrase for contact store " + otrFile + ": "
+	if confirm {
+		prompt = "New passphrase for contact store " + otrFile + ": "
+	}
+	pass, e := readPassphrase(prompt, confirm)
+	if e != nil {
+		return e
+	}
+	storePass = pass
+	return nil
+}
+
+// a new store takes the key's passphrase if there is one
+func otrNewStorePass() error {
+	if keyPass != nil {
+		storePass = append([]byte{}, keyPass...)
+		return nil
+	}
+	return otrStorePass(true)
+}
+
+func otrLoadStore() error {
+	if *otrHashed && !*otrEncrypt {
+		return errors.New("OTR: -otr-hash-nicks needs -otr-encrypt, the hash key would sit in plaintext next to the hashes")
+	}
+	if _, e := os.Stat(otrFile); os.IsNotExist(e) {
+		if _, e := os.Stat(otrFile + ".tmp"); e == nil {
+			PrintLine("OTR: Recovering the contact store from " + otrFile + ".tmp")
+			if e := os.Rename(otrFile+".tmp", otrFile); e != nil {
+				return e
+			}
+		}
+	}
+	conf, e := ioutil.ReadFile(otrFile)
+	if os.IsNotExist(e) {
+		if *otrEncrypt {
+			return otrNewStorePass()
+		}
+		return nil
+	} else if e != nil {
+		return e
+	}
+	migrate := false
+	if IsVault(conf) {
+		var plain []byte
+		if keyPass != nil {
+			// most people use one passphrase for both, don't ask twice
+			if plain, e = VaultOpen(keyPass, conf); e == nil {
+				storePass = append([]byte{}, keyPass...)
+			}
+		}
+		if plain == nil {
+			if e := otrStorePass(false); e != nil {
+				return e
+			}
+			if plain, e = VaultOpen(storePass, conf); e != nil {
+				return e
+			}
+		}
+		conf = plain
+		defer wipe(plain)
+	} else if *otrEncrypt {
+		PrintLine("OTR: Migrating plaintext contact store " + otrFile + " to an encrypted one")
+		if e := otrNewStorePass(); e != nil {
+			return e
+		}
+		migrate = true
+	}
+	if e := json.Unmarshal(conf, OTR); e != nil {
+		return e
+	}
+	if otrMigrateContacts() {
+		migrate = true
+	}
+	if *otrHashed && OTR.HashKey == nil {
+		if e := otrHashNicks(); e != nil {
+			return e
+		}
+		migrate = true
+	} else if !*otrHashed && OTR.HashKey != nil {
+		PrintLine("OTR: Contact store already hashes nicks, it can't go back")
+	}
+	if migrate {
+		return otrWriteStore(true)
+	}
+	return nil
+}
+
+func otrWriteStore(shredOld bool) error {
+	conf, e := json.Marshal(OTR)
+	if e != nil {
+		return e
+	}
+	if storePass != nil {
+		sealed, e := VaultSeal(storePass, conf)
+		wipe(conf)
+		if e != nil {
+			return e
+		}
+		conf = sealed
+	}
+	if !shredOld {
+		return writeFileAtomic(otrFile, conf)
+	}
+	// the new one is safely on disk before the plaintext under it is shredded,
+	// a crash in between leaves it in .tmp for otrLoadStore to pick up
+	tmp := otrFile + ".tmp"
+	if e := writeFileSync(tmp, conf); e != nil {
+		return e
+	}
+	if e := shredFile(otrFile); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return os.Rename(tmp, otrFile)
+}
+
+func OtrSave() {
+	if otrLocked {
+		return // saved when it was locked
+	}
+	if e := otrWriteStore(false); e != nil {
+		PrintError(e)
+	}
+}
+
+func OtrLock() {
+	if otrLocked {
+		PrintLine("OTR: Already locked")
+		return
+	}
+	if storePass == nil {
+		PrintLine("OTR: Contact store isn't encrypted, nothing to lock it with")
+		return
+	}
+	if e := otrWriteStore(false); e != nil {
+		PrintError(e)
+		return
+	}
+	for k, c := range OTR.Contacts {
+		wipe(c.Fingerprint)
+		delete(OTR.Contacts, k)
+	}
+	for k := range OTR.Secrets {
+		delete(OTR.Secrets, k)
+	}
+	// policies, backends and the nick hash key stay, "require" has to hold while locked.
+	// the key's passphrase goes too, it's often the same one
+	wipe(storePass)
+	storePass = nil
+	if keyPass != nil {
+		wipe(keyPass)
+		keyPass = nil
+	}
+	evLock()
+	otrLocked = true
+	PrintLine("OTR: " + ansiColour("Yellow", "Contact store locked, /otr-unlock to open it again"))
+}
+
+// the key's passphrase comes back only if it's the store's, else rotating waits for a restart
+func otrUnlockKey() {
+	if !otrKeyPersistent {
+		return
+	}
+	sealed, e := ioutil.ReadFile(*otrKeyFile)
+	if e != nil {
+		return
+	}
+	if plain, e := VaultOpen(storePass, sealed); e == nil {
+		wipe(plain)
+		keyPass = append([]byte{}, storePass...)
+		return
+	}
+	PrintLine("OTR: The key's passphrase isn't the store's, /otr-key-rotate needs a restart now")
+}
+
+func OtrUnlock(pass []byte) {
+	if !otrLocked {
+		PrintLine("OTR: Not locked")
+		return
+	}
+	conf, e := ioutil.ReadFile(otrFile)
+	if e != nil {
+		wipe(pass)
+		PrintError(e)
+		return
+	}
+	plain, e := VaultOpen(pass, conf)
+	if e != nil {
+		wipe(pass)
+		PrintError(e)
+		return
+	}
+	defer wipe(plain)
+	if e := json.Unmarshal(plain, OTR); e != nil {
+		wipe(pass)
+		PrintError(e)
+		return
+	}
+	storePass = pass
+	otrUnlockKey()
+	otrLocked = false
+	PrintLine("OTR: " + ansiColour("Green", "Contact store unlocked"))
+	otrRecheckLocked()
+	if e := evFlush(); e != nil {
+		PrintError(e)
+	}
+}
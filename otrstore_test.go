@@ -0,0 +1,161 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testStore(t *testing.T, encrypt, hashed bool) {
+	oldEncrypt, oldHashed, oldEvents := *otrEncrypt, *otrHashed, *otrEvents
+	*otrEncrypt, *otrHashed, *otrEvents = encrypt, hashed, false
+	t.Cleanup(func() {
+		*otrEncrypt, *otrHashed, *otrEvents = oldEncrypt, oldHashed, oldEvents
+		keyPass, storePass, otrLocked = nil, nil, false
+	})
+	keyPass, storePass, otrLocked = nil, nil, false
+	otrFile = filepath.Join(t.TempDir(), "otr")
+	OTR = &OtrConf{
+		Contacts: make(map[string]*Contact),
+		Policy:   make(map[string]Policy),
+		Secrets:  make(map[string]string),
+		Backend:  make(map[string]string),
+		conv:     make(map[string]*OtrSession),
+	}
+}
+
+func testContacts() []byte {
+	fp := bytes.Repeat([]byte{0xab}, 20)
+	conf := &OtrConf{Contacts: map[string]*Contact{
+		hex.EncodeToString(fp): {Fingerprint: fp, Trust: TrustSmp, Nicks: []string{"alice"}},
+	}}
+	d, _ := json.Marshal(conf)
+	return d
+}
+
+func TestOtrStoreLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		encrypt bool
+		hashed  bool
+		file    string // what's on disk: "", "plain", "sealed", "tmp"
+		ok      bool
+		sealed  bool // on disk afterwards
+	}{
+		{"new plaintext", false, false, "", true, false},
+		{"plaintext stays", false, false, "plain", true, false},
+		{"plaintext migrated", true, false, "plain", true, true},
+		{"sealed with the key's passphrase", true, false, "sealed", true, true},
+		{"left in .tmp by a crash", true, false, "tmp", true, true},
+		{"hashed nicks in plaintext", false, true, "plain", false, false},
+		{"hashed nicks migrated", true, true, "plain", true, true},
+	}
+	for _, tt := range tests {
+		testStore(t, tt.encrypt, tt.hashed)
+		keyPass = []byte("correct horse")
+		plain := testContacts()
+		switch tt.file {
+		case "plain":
+			os.WriteFile(otrFile, plain, 0600)
+		case "sealed", "tmp":
+			sealed, _ := VaultSeal(keyPass, plain)
+			name := otrFile
+			if tt.file == "tmp" {
+				name += ".tmp"
+			}
+			os.WriteFile(name, sealed, 0600)
+		}
+		e := otrLoadStore()
+		if (e == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, e)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if len(tt.file) > 0 {
+			if c := contactByNick("alice"); c == nil || c.Trust != TrustSmp {
+				t.Errorf("%s: lost alice's contact", tt.name)
+			}
+		}
+		if tt.encrypt && !bytes.Equal(storePass, keyPass) {
+			t.Errorf("%s: store passphrase isn't the key's", tt.name)
+		}
+		if _, e := os.Stat(otrFile + ".tmp"); !os.IsNotExist(e) {
+			t.Errorf("%s: left the .tmp behind", tt.name)
+		}
+		d, e := os.ReadFile(otrFile)
+		if len(tt.file) > 0 && IsVault(d) != tt.sealed {
+			t.Errorf("%s: sealed %v on disk, want %v (%v)", tt.name, IsVault(d), tt.sealed, e)
+		}
+		if tt.hashed && bytes.Contains(d, []byte("alice")) {
+			t.Errorf("%s: nick on disk", tt.name)
+		}
+		if tt.sealed {
+			if opened, e := VaultOpen(keyPass, d); e != nil || !bytes.Contains(opened, []byte("Contacts")) {
+				t.Errorf("%s: can't open what was written: %v", tt.name, e)
+			}
+		}
+	}
+}
+
+func TestOtrSecretNeedsEncryption(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		testStore(t, encrypt, false)
+		keyPass = []byte("correct horse")
+		if e := otrLoadStore(); e != nil {
+			t.Fatal(e)
+		}
+		OtrSetSecret("alice", "our secret")
+		OtrSave()
+		d, _ := os.ReadFile(otrFile)
+		if _, kept := OTR.Secrets[contactKey("alice")]; kept != encrypt || bytes.Contains(d, []byte("our secret")) {
+			t.Errorf("encrypt %v: secret kept %v, on disk in plaintext %v", encrypt, kept, bytes.Contains(d, []byte("our secret")))
+		}
+	}
+}
+
+func TestOtrLockUnlock(t *testing.T) {
+	testStore(t, true, false)
+	keyPass = []byte("correct horse")
+	os.WriteFile(otrFile, testContacts(), 0600)
+	if e := otrLoadStore(); e != nil {
+		t.Fatal(e)
+	}
+	key := keyPass
+	OtrLock()
+	if !otrLocked || storePass != nil || keyPass != nil || len(OTR.Contacts) > 0 {
+		t.Fatal("lock left passphrases or contacts in memory")
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Error("key passphrase not zeroed")
+	}
+	wrong := []byte("correct horsf")
+	OtrUnlock(wrong)
+	if !otrLocked || !bytes.Equal(wrong, make([]byte, len(wrong))) {
+		t.Error("wrong passphrase unlocked, or wasn't zeroed")
+	}
+	OtrUnlock([]byte("correct horse"))
+	if otrLocked || contactByNick("alice") == nil {
+		t.Error("right passphrase didn't unlock")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+type Policy int
+
+const (
+	PolicyManual Policy = iota
+	PolicyOpportunistic
+	PolicyRequire
+	PolicyNever
+)
+
+var policyNames = map[Policy]string{
+	PolicyManual:        "manual",
+	PolicyOpportunistic: "opportunistic",
+	PolicyRequire:       "require",
+	PolicyNever:         "never",
+}
+
+func (p Policy) String() string {
+	return policyNames[p]
+}
+
+func (p Policy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Policy) UnmarshalText(b []byte) error {
+	for k, v := range policyNames {
+		if v == string(b) {
+			*p = k
+			return nil
+		}
+	}
+	return errors.New("unknown OTR policy '" + string(b) + "', try manual, opportunistic, require or never")
+}
+
+// whitespace tag announcing OTRv2, appended to plaintext under opportunistic
+const otrWhitespaceTag = "\x20\x09\x20\x20\x09\x09\x09\x09\x20\x09\x20\x09\x20\x09\x20\x20" + "\x20\x20\x09\x09\x20\x20\x09\x20"
+
+var otrDefaultPolicy = PolicyManual
+
+func otrPolicy(rcpt string) Policy {
+	if p, ok := OTR.Policy[contactKey(rcpt)]; ok {
+		return p
+	}
+	return otrDefaultPolicy
+}
+
+func stripWhitespaceTag(s string) (string, bool) {
+	i := strings.Index(s, otrWhitespaceTag[:16])
+	if i < 0 {
+		return s, false
+	}
+	// the base tag is followed by any number of 8 byte version tags
+	end := i + 16
+	for end+8 <= len(s) && strings.Trim(s[end:end+8], " \t") == "" {
+		end += 8
+	}
+	return s[:i] + s[end:], true
+}
+
+func stripWhitespaceTagBytes(b []byte) ([]byte, bool) {
+	s, tagged := stripWhitespaceTag(string(b))
+	return []byte(s), tagged
+}
+
+func OtrSetPolicy(rcpt, policy string) {
+	if len(policy) < 1 {
+		PrintLine("OTR: Policy for " + rcpt + " is " + otrPolicy(rcpt).String())
+		return
+	}
+	if policy == "default" {
+		delete(OTR.Policy, contactKey(rcpt))
+		PrintLine("OTR: Policy for " + rcpt + " is back to the default " + otrDefaultPolicy.String())
+		return
+	}
+	var p Policy
+	if e := p.UnmarshalText([]byte(policy)); e != nil {
+		PrintError(e)
+		return
+	}
+	OTR.Policy[contactKey(rcpt)] = p
+	PrintLine("OTR: Policy for " + rcpt + " is now " + p.String())
+}
+
+func OtrPolicies() {
+	PrintLine("OTR: Default policy is " + otrDefaultPolicy.String())
+	var keys []string
+	for k := range OTR.Policy {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		PrintLine("OTR: Policy for " + k + " is " + OTR.Policy[k].String())
+	}
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import "sync"
+
+// the server side never waits on the terminal: PINGs and OTR are handled as
+// lines arrive and rendering catches up from here, dropping if it can't
+type uiEvent struct {
+	m      *Msg
+	line   string
+	repeat int // similar events folded into this one
+}
+
+// the same line again, or once we're backing up, the same kind of server
+// chatter (a netsplit's worth of QUITs) in a row
+func (ev *uiEvent) similar(o uiEvent, busy bool) bool {
+	if ev.m == nil || o.m == nil {
+		return ev.m == o.m && ev.line == o.line
+	}
+	a, b := ev.m, o.m
+	if a.cmd == b.cmd && a.nick == b.nick && a.rcpt == b.rcpt && a.content == b.content {
+		return true
+	}
+	return busy && a.cmd == b.cmd && a.cmd != "PRIVMSG" && a.cmd != "NOTICE"
+}
+
+type msgQueue struct {
+	sync.Mutex
+	events  []uiEvent
+	max     int
+	dropped int
+	wake    chan bool
+}
+
+func newMsgQueue(max int) *msgQueue {
+	return &msgQueue{
+		max:  max,
+		wake: make(chan bool, 1),
+	}
+}
+
+func (q *msgQueue) push(ev uiEvent) {
+	q.Lock()
+	if n := len(q.events); n > 0 && q.events[n-1].similar(ev, n >= q.max/2) {
+		q.events[n-1].repeat++
+		q.Unlock()
+		q.poke()
+		return
+	}
+	if len(q.events) >= q.max {
+		q.dropOne()
+	}
+	q.events = append(q.events, ev)
+	q.Unlock()
+	q.poke()
+}
+
+func (q *msgQueue) poke() {
+	select {
+	case q.wake <- true:
+	default: // already signalled, the renderer will pick this up too
+	}
+}
+
+// server chatter goes first, our own notices only when there's nothing else
+func (q *msgQueue) dropOne() {
+	q.dropped++
+	for i, ev := range q.events {
+		if ev.m != nil {
+			q.events = append(q.events[:i], q.events[i+1:]...)
+			return
+		}
+	}
+	q.events = q.events[1:]
+}
+
+func (q *msgQueue) drain() ([]uiEvent, int) {
+	q.Lock()
+	defer q.Unlock()
+	events, dropped := q.events, q.dropped
+	q.events = nil
+	q.dropped = 0
+	return events, dropped
+}
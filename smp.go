@@ -0,0 +1,209 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/otr"
+)
+
+const (
+	smpIdle    = iota
+	smpAsked   // we started it, waiting on them
+	smpAsking  // they started it, waiting on our secret
+	smpRunning // both secrets in, exchanging
+)
+
+var smpStates = map[int]string{
+	smpIdle:    "idle",
+	smpAsked:   "waiting for them",
+	smpAsking:  "waiting for your answer",
+	smpRunning: "in progress",
+}
+
+const otrSmpTimeout = 2 * time.Minute
+
+func otrSmpSend(rcpt string, msgs [][]byte) {
+	for _, msg := range msgs {
+		send <- "PRIVMSG " + rcpt + " :" + string(msg)
+	}
+}
+
+func otrSmpBegin(sess *OtrSession, state int) {
+	started := time.Now()
+	sess.smp = state
+	sess.smpStarted = started
+	sess.smpIgnore = false
+	time.AfterFunc(otrSmpTimeout, func() {
+		post(func() { otrSmpTimedOut(sess, started) })
+	})
+}
+
+func otrSmpTimedOut(sess *OtrSession, started time.Time) {
+	for rcpt, s := range OTR.conv {
+		if s == sess && sess.smp != smpIdle && sess.smpStarted.Equal(started) {
+			PrintLine("OTR: SMP with " + rcpt + " " + ansiColour("Red", "timed out"))
+			OtrSmpAbort(rcpt)
+		}
+	}
+}
+
+// an empty question is the question-less, shared secret only variant
+func OtrSmpQuestion(rcpt, quest, resp string) {
+	rcpt = strings.ToLower(rcpt)
+	if _, ok := OTR.conv[rcpt]; ok == false {
+		OTR.conv[rcpt] = OtrNew()
+	}
+	sess := OTR.conv[rcpt]
+	msgs, e := sess.Authenticate(quest, []byte(resp))
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	otrSmpSend(rcpt, msgs)
+	otrSmpBegin(sess, smpAsked)
+	PrintLine("OTR: SMP with " + rcpt + " started, " + smpStates[sess.smp])
+}
+
+func OtrSmpResp(rcpt, resp string) {
+	rcpt = strings.ToLower(rcpt)
+	sess, ok := OTR.conv[rcpt]
+	if !ok || sess.smp != smpAsking {
+		PrintLine("OTR: " + rcpt + " hasn't asked anything")
+		return
+	}
+	msgs, e := sess.Authenticate(sess.SMPQuestion(), []byte(resp))
+	if e != nil {
+		PrintError(e)
+		return
+	}
+	otrSmpSend(rcpt, msgs)
+	sess.smp = smpRunning
+	PrintLine("OTR: SMP with " + rcpt + " " + smpStates[sess.smp])
+}
+
+// the library can't send an abort on its own. if they asked we answer with
+// junk so it fails on both ends, if we asked their late answer is ignored.
+func OtrSmpAbort(rcpt string) {
+	rcpt = strings.ToLower(rcpt)
+	sess, ok := OTR.conv[rcpt]
+	if !ok || sess.smp == smpIdle {
+		PrintLine("OTR: No SMP with " + rcpt + " to abort")
+		return
+	}
+	if sess.smp == smpAsking {
+		junk := make([]byte, 32)
+		rand.Read(junk)
+		msgs, e := sess.Authenticate(sess.SMPQuestion(), []byte(hex.EncodeToString(junk)))
+		if e != nil {
+			PrintError(e)
+		}
+		otrSmpSend(rcpt, msgs)
+	}
+	sess.smp = smpIdle
+	sess.smpIgnore = true
+	PrintLine("OTR: SMP with " + rcpt + " " + ansiColour("Yellow", "aborted"))
+	otrLog(rcpt, "smp-aborted", "")
+}
+
+func otrSmpChange(rcpt string, chg otr.SecurityChange) {
+	sess := OTR.conv[rcpt]
+	switch chg {
+	case otr.SMPSecretNeeded:
+		otrSmpBegin(sess, smpAsking)
+		smpq := sess.SMPQuestion()
+		if secret, ok := OTR.Secrets[contactKey(rcpt)]; ok && len(smpq) < 1 {
+			PrintLine("OTR: " + rcpt + " started SMP, answering with the pre-agreed secret")
+			OtrSmpResp(rcpt, secret)
+		} else if len(smpq) < 1 {
+			PrintLine("OTR: " + rcpt + " asks for your shared secret. Type '/otr-smpr " + rcpt + " <secret>' to answer.")
+		} else {
+			PrintLine("OTR: " + rcpt + " asks '" + smpq + "'. Type '/otr-smpr " + rcpt + " <response>' to answer.")
+		}
+	case otr.SMPComplete, otr.SMPFailed:
+		sess.smp = smpIdle
+		if sess.smpIgnore {
+			sess.smpIgnore = false
+			PrintLine("OTR: Ignored the result of the aborted SMP with " + rcpt)
+			return
+		}
+		if chg == otr.SMPFailed {
+			PrintLine("OTR: " + rcpt + " " + ansiColour("Red", "failed") + " authentication.")
+			otrLog(rcpt, "smp-failed", "")
+			return
+		}
+		PrintLine("OTR: " + rcpt + " " + ansiColour("Green", "completed") + " authentication.")
+		otrLog(rcpt, "smp-ok", "")
+		if !otrLocked {
+			setContact(rcpt, sess.TheirPublicKey.Fingerprint(), TrustSmp, "SMP")
+		}
+		if sess.blocked {
+			otrUnblock(rcpt)
+		}
+	}
+}
+
+// whoever started the AKE starts the SMP too, so both sides don't cross
+func otrSmpAuto(rcpt string, initiated bool) {
+	secret, ok := OTR.Secrets[contactKey(rcpt)]
+	if !ok || !initiated || OTR.conv[rcpt].smp != smpIdle {
+		return
+	}
+	if tr := OtrTrust(rcpt); tr == TrustSmp || tr == TrustManual {
+		return
+	}
+	PrintLine("OTR: Verifying " + rcpt + " with the pre-agreed secret")
+	OtrSmpQuestion(rcpt, "", secret)
+}
+
+func OtrSetSecret(rcpt, secret string) {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	if secret == "-" {
+		delete(OTR.Secrets, contactKey(rcpt))
+		PrintLine("OTR: Forgot the pre-agreed secret for " + rcpt)
+		return
+	}
+	if storePass == nil {
+		// the store would be plain json on disk, secret and all
+		PrintLine("OTR: " + ansiColour("Red", "Not kept, the contact store isn't encrypted") + ", pre-agreed secrets need -otr-encrypt")
+		return
+	}
+	OTR.Secrets[contactKey(rcpt)] = secret
+	PrintLine("OTR: Sessions with " + rcpt + " will be verified with the pre-agreed secret")
+}
+
+func OtrSecrets() {
+	var keys []string
+	for k := range OTR.Secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		PrintLine("OTR: Pre-agreed secret set for " + k)
+	}
+	if len(keys) < 1 {
+		PrintLine("OTR: No pre-agreed secrets")
+	}
+}
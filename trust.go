@@ -0,0 +1,272 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Trust int
+
+const (
+	TrustTofu Trust = iota
+	TrustSmp
+	TrustManual
+	TrustRevoked
+)
+
+var trustNames = map[Trust]string{
+	TrustTofu:    "unverified",
+	TrustSmp:     "smp",
+	TrustManual:  "manual",
+	TrustRevoked: "revoked",
+}
+
+func (tr Trust) String() string {
+	return trustNames[tr]
+}
+
+func (tr Trust) MarshalText() ([]byte, error) {
+	return []byte(tr.String()), nil
+}
+
+func (tr *Trust) UnmarshalText(b []byte) error {
+	for k, v := range trustNames {
+		if v == string(b) {
+			*tr = k
+			return nil
+		}
+	}
+	return errors.New("unknown trust level '" + string(b) + "'")
+}
+
+func (tr Trust) Colour() string {
+	switch tr {
+	case TrustSmp, TrustManual:
+		return "Green"
+	case TrustRevoked:
+		return "Red"
+	default:
+		return "Yellow"
+	}
+}
+
+// a contact is a key, the nicks are just where we last saw it
+type Contact struct {
+	Fingerprint []byte
+	Trust       Trust
+	Since       time.Time
+	How         string   `json:",omitempty"`
+	Nicks       []string `json:",omitempty"` // contactKey()s
+}
+
+// stores from before trust levels were a bare fingerprint per nick
+func (c *Contact) UnmarshalJSON(b []byte) error {
+	var fp []byte
+	if json.Unmarshal(b, &fp) == nil {
+		*c = Contact{Fingerprint: fp, Trust: TrustTofu, How: "imported from old store"}
+		return nil
+	}
+	type contact Contact
+	return json.Unmarshal(b, (*contact)(c))
+}
+
+func newContact(fp []byte, tr Trust, how string) *Contact {
+	return &Contact{
+		Fingerprint: fp,
+		Trust:       tr,
+		Since:       time.Now().UTC(),
+		How:         how,
+	}
+}
+
+func (c *Contact) String() string {
+	s := ansiColour(c.Trust.Colour(), c.Trust.String())
+	if !c.Since.IsZero() {
+		s += " since " + c.Since.Format("2006-01-02 15:04")
+	}
+	if len(c.How) > 0 {
+		s += " (" + c.How + ")"
+	}
+	return s
+}
+
+func (c *Contact) hasNick(k string) bool {
+	for _, n := range c.Nicks {
+		if n == k {
+			return true
+		}
+	}
+	return false
+}
+
+func contactByFingerprint(fp []byte) *Contact {
+	return OTR.Contacts[hex.EncodeToString(fp)]
+}
+
+// the key last seen using nick, if any
+func contactByNick(nick string) *Contact {
+	k := contactKey(nick)
+	for _, c := range OTR.Contacts {
+		if c.hasNick(k) {
+			return c
+		}
+	}
+	return nil
+}
+
+// a nick only ever points at one key
+func claimNick(c *Contact, nick string) {
+	k := contactKey(nick)
+	for _, other := range OTR.Contacts {
+		if other == c {
+			continue
+		}
+		for i, n := range other.Nicks {
+			if n == k {
+				other.Nicks = append(other.Nicks[:i], other.Nicks[i+1:]...)
+				break
+			}
+		}
+	}
+	if !c.hasNick(k) {
+		c.Nicks = append(c.Nicks, k)
+	}
+}
+
+func setContact(nick string, fp []byte, tr Trust, how string) *Contact {
+	c := newContact(fp, tr, how)
+	if old := contactByFingerprint(fp); old != nil {
+		c.Nicks = old.Nicks
+	}
+	OTR.Contacts[hex.EncodeToString(fp)] = c
+	claimNick(c, nick)
+	return c
+}
+
+// stores from before contacts were keyed by fingerprint
+func otrMigrateContacts() bool {
+	if len(OTR.Contact) < 1 {
+		return false
+	}
+	for k, c := range OTR.Contact {
+		if old := contactByFingerprint(c.Fingerprint); old != nil {
+			old.Nicks = append(old.Nicks, k)
+			continue
+		}
+		c.Nicks = []string{k}
+		OTR.Contacts[hex.EncodeToString(c.Fingerprint)] = c
+	}
+	OTR.Contact = nil
+	return true
+}
+
+func theirFingerprint(rcpt string) []byte {
+	if c, ok := OTR.conv[strings.ToLower(rcpt)]; ok && c.IsEncrypted() {
+		return c.TheirPublicKey.Fingerprint()
+	}
+	return nil
+}
+
+// how far the live session with rcpt can be trusted, revoked if the nick's key changed
+func OtrTrust(rcpt string) Trust {
+	current := theirFingerprint(rcpt)
+	if current == nil || otrLocked {
+		return TrustTofu
+	}
+	if c := contactByFingerprint(current); c != nil {
+		return c.Trust
+	}
+	if contactByNick(rcpt) != nil {
+		return TrustRevoked
+	}
+	return TrustTofu
+}
+
+func OtrSetTrust(rcpt string, tr Trust, how string) {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	fp := theirFingerprint(rcpt)
+	if fp == nil {
+		if c := contactByNick(rcpt); c != nil {
+			fp = c.Fingerprint
+		} else {
+			PrintLine("OTR: No session with or stored fingerprint for " + rcpt)
+			return
+		}
+	}
+	c := setContact(rcpt, fp, tr, how)
+	if tr == TrustRevoked {
+		otrLog(rcpt, "key-revoked", how)
+	} else {
+		otrLog(rcpt, "trusted", tr.String()+", "+how)
+	}
+	PrintLine("OTR: Contact " + rcpt + " " + fingerprint(fp, true) + " is now " + c.String())
+	if sess, ok := OTR.conv[strings.ToLower(rcpt)]; ok && sess.blocked && tr != TrustRevoked {
+		otrUnblock(strings.ToLower(rcpt))
+	}
+}
+
+// by nick or by the hex fingerprint /otr-contacts shows
+func OtrForget(who string) {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	c := contactByNick(who)
+	if c == nil {
+		c = OTR.Contacts[strings.ToLower(strings.Replace(who, ":", "", -1))]
+	}
+	if c == nil {
+		PrintLine("OTR: No stored fingerprint for " + who)
+		return
+	}
+	otrLog(who, "forgotten", hex.EncodeToString(c.Fingerprint))
+	delete(OTR.Contacts, hex.EncodeToString(c.Fingerprint))
+	PrintLine("OTR: Forgot " + who + ", the next session will be trust-on-first-use again")
+}
+
+func OtrContacts() {
+	if otrLocked {
+		PrintLine("OTR: Unlock first with /otr-unlock")
+		return
+	}
+	var keys []string
+	for k := range OTR.Contacts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c := OTR.Contacts[k]
+		nicks := strings.Join(c.Nicks, ",")
+		if OTR.HashKey != nil {
+			nicks = strconv.Itoa(len(c.Nicks)) + " hashed nick(s)"
+		}
+		PrintLine("OTR: " + k + " " + c.String() + " seen as " + nicks)
+	}
+	if len(keys) < 1 {
+		PrintLine("OTR: No contacts stored")
+	}
+}
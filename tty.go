@@ -19,7 +19,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -33,24 +35,51 @@ func PrintHelp() {
 	PrintLine("/ctcp <rcpt> <msg> - CTCP a channel or user with msg")
 	PrintLine("/ignore <rcpt> - Ignore messages from rcpt")
 	PrintLine("/unignore <rcpt> - Unignore rcpt")
+	PrintLine("/e2e [rcpt] [backend|default] - Show or pick the end-to-end backend for a user")
 	PrintLine("/otr-start <rcpt> - Request an OTR session with a user")
 	PrintLine("/otr-end <rcpt> - End an OTR session with a user")
 	PrintLine("/otr-status <rcpt> - Check the status of OTR with a user")
+	PrintLine("/otr-instances <rcpt> - List the OTR clients seen for a user and which one the session is with")
+	PrintLine("/leek-verify <rcpt|tls> <words...> - Check leekspeak read aloud against a live OTR or TLS fingerprint")
+	PrintLine("/leek-words [leek|pgp|easy|file] - Show or change the fingerprint word list")
 	PrintLine("/otr-info - Print your OTR fingerprint, if loaded")
 	PrintLine("/otr-smpr <rcpt> <response> - Response to an SMP question")
 	PrintLine("/otr-smpq <rcpt> <question>? <response> - Pose an SMP question (question must end with a ?)")
+	PrintLine("/otr-smp <rcpt> <secret> - Start SMP with a shared secret and no question")
+	PrintLine("/otr-smp-abort <rcpt> - Abort an SMP in progress")
+	PrintLine("/otr-secret [rcpt] [secret|-] - List, set or clear (-) a pre-agreed secret for automatic SMP")
+	PrintLine("/otr-policy [rcpt] [manual|opportunistic|require|never|default] - Show or set the OTR policy")
+	PrintLine("/otr-accept <rcpt> - Accept rcpt's changed fingerprint and send held messages")
+	PrintLine("/otr-trust <rcpt> [how] - Mark rcpt's fingerprint as verified by hand (e.g. leekspeak read aloud)")
+	PrintLine("/otr-distrust <rcpt> - Revoke trust in rcpt's fingerprint")
+	PrintLine("/otr-forget <rcpt> - Forget rcpt's fingerprint entirely")
+	PrintLine("/otr-events [rcpt|fingerprint] [count] - Show the security event journal, optionally for one contact")
+	PrintLine("/otr-contacts - List stored fingerprints and how far they are trusted")
+	PrintLine("/otr-lock - Save the contact store and wipe it from memory")
+	PrintLine("/otr-unlock - Ask for the passphrase and open the contact store again")
+	PrintLine("/otr-import fingerprints|key <file> [account] - Import libotr's otr.fingerprints or otr.private_key")
+	PrintLine("/otr-export fingerprints|key <file> - Export contacts or your persistent key in libotr's formats")
+	PrintLine("/otr-key-rotate - Replace your persistent OTR key with a new one")
+	PrintLine("/otr-key-destroy yes - Shred your persistent OTR key and go back to ephemeral keys")
+	PrintLine("/chan-key [#channel] [new|share <nick>|remove <nick>|accept <nick>|reject <nick>|rotate|off] - Encrypt a channel and hand its key out over verified encrypted sessions")
+	PrintLine("/send-file <rcpt> <path> - Offer a file over an encrypted session")
+	PrintLine("/accept-file <rcpt> <id> - Accept (or resume) an offered file")
+	PrintLine("/reject-file <rcpt> <id> - Decline an offered file")
+	PrintLine("/files - List file transfers in progress")
 	PrintLine("/raw <request> - Send a raw input line to the server")
 	PrintLine("/help - this screen!")
 	PrintLine("by default, message are sent to the previous user or channel")
 }
 
 var (
-	t         *terminal.Terminal
-	promptEnd string = "> "
-	curRcpt   string
-	tw, th    int
-	escapes   = map[string]string{}
-	printMap  = map[string]func(m *Msg){
+	t          *terminal.Terminal
+	promptEnd  string = "> "
+	curRcpt    string
+	prompt     string
+	promptLock sync.Mutex
+	tw, th     int
+	escapes    = map[string]string{}
+	printMap   = map[string]func(m *Msg){
 		"NOTICE":  noticeMsg,
 		"ERROR":   errorMsg,
 		"PRIVMSG": privMsg,
@@ -62,23 +91,48 @@ var (
 		"MODE":    modeMsg,
 	}
 	inputMap = map[string]func(args string){
-		"join":       inputJoin,
-		"part":       inputPart,
-		"quit":       inputQuit,
-		"msg":        inputMsg,
-		"nick":       inputNick,
-		"ctcp":       inputCtcp,
-		"ignore":     inputIgnore,
-		"unignore":   inputUnignore,
-		"otr-start":  inputOtrInit,
-		"otr-end":    inputOtrEnd,
-		"otr-status": inputOtrStatus,
-		"otr-info":   inputOtrInfo,
-		"otr-smpr":   inputOtrSmpr,
-		"otr-smpq":   inputOtrSmpq,
-		"raw":        inputRaw,
-		"help":       inputHelp,
-		"shrug":      inputShrug,
+		"join":            inputJoin,
+		"part":            inputPart,
+		"quit":            inputQuit,
+		"msg":             inputMsg,
+		"nick":            inputNick,
+		"ctcp":            inputCtcp,
+		"ignore":          inputIgnore,
+		"unignore":        inputUnignore,
+		"e2e":             inputE2e,
+		"otr-start":       inputOtrInit,
+		"otr-end":         inputOtrEnd,
+		"otr-status":      inputOtrStatus,
+		"otr-instances":   inputOtrInstances,
+		"leek-verify":     inputLeekVerify,
+		"leek-words":      inputLeekWords,
+		"otr-info":        inputOtrInfo,
+		"otr-smpr":        inputOtrSmpr,
+		"otr-smpq":        inputOtrSmpq,
+		"otr-smp":         inputOtrSmp,
+		"otr-smp-abort":   inputOtrSmpAbort,
+		"otr-secret":      inputOtrSecret,
+		"otr-policy":      inputOtrPolicy,
+		"otr-accept":      inputOtrAccept,
+		"otr-trust":       inputOtrTrust,
+		"otr-distrust":    inputOtrDistrust,
+		"otr-forget":      inputOtrForget,
+		"otr-events":      inputOtrEvents,
+		"otr-contacts":    inputOtrContacts,
+		"otr-lock":        inputOtrLock,
+		"otr-unlock":      inputOtrUnlock,
+		"otr-import":      inputOtrImport,
+		"otr-export":      inputOtrExport,
+		"otr-key-rotate":  inputOtrKeyRotate,
+		"otr-key-destroy": inputOtrKeyDestroy,
+		"chan-key":        inputChanKey,
+		"send-file":       inputSendFile,
+		"accept-file":     inputAcceptFile,
+		"reject-file":     inputRejectFile,
+		"files":           inputFiles,
+		"raw":             inputRaw,
+		"help":            inputHelp,
+		"shrug":           inputShrug,
 	}
 	IgnoreMap = make(map[string]bool)
 )
@@ -87,6 +141,57 @@ func inputHelp(args string) {
 	PrintHelp()
 }
 
+func inputChanKey(args string) {
+	channel, args := split(args, " ")
+	channel = strings.ToLower(channel)
+	cmd, nick := split(args, " ")
+	switch {
+	case len(channel) < 1:
+		GrpList()
+	case !strings.HasPrefix(channel, "#"):
+		PrintLine("Usage: /chan-key [#channel] [new|share <nick>|remove <nick>|accept <nick>|reject <nick>|rotate|off]")
+	case cmd == "new":
+		GrpNew(channel)
+	case cmd == "share" && len(nick) > 0:
+		if _, ok := grpChans[channel]; !ok {
+			PrintLine("GRP: " + channel + " has no key, '/chan-key " + channel + " new' first")
+			return
+		}
+		grpShare(channel, nick)
+	case cmd == "remove" && len(nick) > 0:
+		GrpRemove(channel, nick)
+	case cmd == "accept" && len(nick) > 0:
+		GrpAccept(channel, nick)
+	case cmd == "reject" && len(nick) > 0:
+		GrpReject(channel, nick)
+	case cmd == "rotate":
+		GrpRotate(channel)
+	case cmd == "off":
+		GrpOff(channel)
+	default:
+		PrintLine("Usage: /chan-key [#channel] [new|share <nick>|remove <nick>|accept <nick>|reject <nick>|rotate|off]")
+	}
+}
+
+func inputSendFile(args string) {
+	rcpt, path := split(args, " ")
+	SendFile(rcpt, path)
+}
+
+func inputAcceptFile(args string) {
+	rcpt, id := split(args, " ")
+	AcceptFile(rcpt, id)
+}
+
+func inputRejectFile(args string) {
+	rcpt, id := split(args, " ")
+	RejectFile(rcpt, id)
+}
+
+func inputFiles(args string) {
+	Files()
+}
+
 func inputRaw(args string) {
 	Raw(args)
 }
@@ -118,27 +223,173 @@ func inputOtrSmpq(args string) {
 	OtrSmpQuestion(rcpt, quest, resp)
 }
 
+func inputOtrSmp(args string) {
+	rcpt, secret := split(args, " ")
+	if len(secret) < 1 {
+		PrintLine("Usage: /otr-smp <rcpt> <secret>")
+		return
+	}
+	OtrSmpQuestion(rcpt, "", secret)
+}
+
+func inputOtrSmpAbort(args string) {
+	OtrSmpAbort(args)
+}
+
+func inputOtrSecret(args string) {
+	rcpt, secret := split(args, " ")
+	if len(rcpt) < 1 {
+		OtrSecrets()
+		return
+	}
+	if len(secret) < 1 {
+		PrintLine("Usage: /otr-secret <rcpt> <secret|->")
+		return
+	}
+	OtrSetSecret(rcpt, secret)
+}
+
 func inputOtrSmpr(args string) {
 	rcpt, msg := split(args, " ")
 	OtrSmpResp(rcpt, msg)
 }
 
+func inputOtrPolicy(args string) {
+	rcpt, policy := split(args, " ")
+	if len(rcpt) < 1 {
+		OtrPolicies()
+		return
+	}
+	OtrSetPolicy(rcpt, policy)
+}
+
+func inputOtrAccept(args string) {
+	OtrAccept(args)
+}
+
+func inputOtrTrust(args string) {
+	rcpt, how := split(args, " ")
+	if len(how) < 1 {
+		how = "leekspeak"
+	}
+	OtrSetTrust(rcpt, TrustManual, how)
+}
+
+func inputOtrDistrust(args string) {
+	OtrSetTrust(args, TrustRevoked, "/otr-distrust")
+}
+
+func inputOtrForget(args string) {
+	OtrForget(args)
+}
+
+func inputOtrEvents(args string) {
+	who, count := split(args, " ")
+	if _, e := strconv.Atoi(who); e == nil && len(count) < 1 {
+		who, count = "", who
+	}
+	n, e := strconv.Atoi(count)
+	if e != nil || n < 1 {
+		n = 50
+	}
+	OtrEvents(who, n)
+}
+
+func inputOtrContacts(args string) {
+	OtrContacts()
+}
+
+func inputOtrLock(args string) {
+	OtrLock()
+}
+
+func inputOtrImport(args string) {
+	what, args := split(args, " ")
+	name, account := split(args, " ")
+	switch {
+	case len(name) < 1:
+		PrintLine("Usage: /otr-import fingerprints|key <file> [account]")
+	case what == "fingerprints":
+		OtrImportFingerprints(name, account)
+	case what == "key":
+		OtrImportKey(name, account)
+	default:
+		PrintLine("Usage: /otr-import fingerprints|key <file> [account]")
+	}
+}
+
+func inputOtrExport(args string) {
+	what, name := split(args, " ")
+	switch {
+	case len(name) < 1:
+		PrintLine("Usage: /otr-export fingerprints|key <file>")
+	case what == "fingerprints":
+		OtrExportFingerprints(name)
+	case what == "key":
+		OtrExportKey(name)
+	default:
+		PrintLine("Usage: /otr-export fingerprints|key <file>")
+	}
+}
+
+// the input loop reads the passphrase itself, only arguments end up here
+func inputOtrUnlock(args string) {
+	PrintLine("Usage: /otr-unlock, on its own, then type the passphrase")
+}
+
+func inputOtrKeyRotate(args string) {
+	OtrRotateKey()
+}
+
+func inputOtrKeyDestroy(args string) {
+	if args != "yes" {
+		PrintLine("This can't be undone, type '/otr-key-destroy yes' if you mean it")
+		return
+	}
+	OtrDestroyKey()
+}
+
+func inputOtrInstances(args string) {
+	OtrInstances(args)
+}
+
+func inputLeekVerify(args string) {
+	who, words := split(args, " ")
+	if len(words) < 1 {
+		PrintLine("Usage: /leek-verify <rcpt|tls> <words...>")
+		return
+	}
+	LeekVerify(who, words)
+}
+
+func inputLeekWords(args string) {
+	LeekSetWords(args)
+}
+
 func inputOtrInfo(args string) {
 	OtrInfo()
 }
 
 func inputOtrStatus(args string) {
-	OtrStatus(args)
+	backendFor(args).Status(args)
 }
 
 func inputOtrInit(args string) {
 	curRcpt = args
-	OtrStart(args)
-	updateTerm()
+	backendFor(args).Start(args)
 }
 
 func inputOtrEnd(args string) {
-	OtrEnd(args)
+	backendFor(args).End(args)
+}
+
+func inputE2e(args string) {
+	rcpt, name := split(args, " ")
+	if len(rcpt) < 1 {
+		E2eBackends()
+		return
+	}
+	E2eSetBackend(rcpt, name)
 }
 
 func inputCtcp(args string) {
@@ -153,7 +404,6 @@ func inputNick(args string) {
 func inputJoin(args string) {
 	curRcpt = args
 	Join(args)
-	updateTerm()
 }
 
 func inputPart(args string) {
@@ -172,7 +422,6 @@ func inputMsg(args string) {
 	rcpt, msg := split(args, " ")
 	curRcpt = rcpt
 	SendTo(rcpt, msg)
-	updateTerm()
 }
 
 func setEscapeCodes() {
@@ -196,13 +445,13 @@ func modeMsg(m *Msg) {
 	s += " " + m.nick + " set mode "
 	s += "[" + m.args + m.content + "] "
 	s += "for " + m.rcpt
-	PrintLine(s)
+	writeLine(s)
 }
 
 func kickMsg(m *Msg) {
 	s := "[" + m.timestamp + "]"
 	s += " " + m.nick + " kicked " + m.args + " from " + m.rcpt + " [" + m.content + "]"
-	PrintLine(s)
+	writeLine(s)
 }
 
 func privMsg(m *Msg) {
@@ -212,7 +461,9 @@ func privMsg(m *Msg) {
 		return
 	}
 	s := "[" + m.timestamp + "]"
-	if m.rcpt[0] == '#' {
+	if m.grp {
+		colour = "Blue"
+	} else if strings.HasPrefix(m.rcpt, "#") {
 		colour = "Yellow"
 	} else if m.enc {
 		colour = "Green"
@@ -232,20 +483,27 @@ func privMsg(m *Msg) {
 	} else {
 		s += " " + m.content
 	}
-	PrintLine(s)
+	writeLine(s)
 }
 
 func nickMsg(m *Msg) {
 	s := "[" + m.timestamp + "]"
-	s += " " + m.nick + " is now known as " + m.content
-	if _, ok := IgnoreMap[m.content]; ok {
-		delete(IgnoreMap, m.content)
+	s += " " + m.nick + " is now known as " + m.newNick()
+	writeLine(s)
+}
+
+func followNick(m *Msg) {
+	to := m.newNick()
+	if strings.EqualFold(curRcpt, m.nick) {
+		curRcpt = to
+	}
+	if _, ok := IgnoreMap[to]; ok {
+		delete(IgnoreMap, to)
 	}
 	if _, ok := IgnoreMap[m.nick]; ok {
-		IgnoreMap[m.content] = true
+		IgnoreMap[to] = true
 		delete(IgnoreMap, m.nick)
 	}
-	PrintLine(s)
 }
 
 func noticeMsg(m *Msg) {
@@ -256,7 +514,7 @@ func noticeMsg(m *Msg) {
 		s += " [" + ansiColour("Yellow", m.args) + "]"
 	}
 	s += " " + ansiColour("Yellow", m.content)
-	PrintLine(s)
+	writeLine(s)
 }
 
 func errorMsg(m *Msg) {
@@ -267,14 +525,14 @@ func errorMsg(m *Msg) {
 		s += " [" + ansiColour("Magenta", m.args) + "]"
 	}
 	s += " " + ansiColour("Magenta", m.content)
-	PrintLine(s)
+	writeLine(s)
 }
 
 func partMsg(m *Msg) {
 	if !*ircClean {
 		s := "[" + m.timestamp + "]"
 		s += " " + m.nick + " [" + m.user + "@" + m.host + "]" + " has left " + m.rcpt + " [" + m.content + "]"
-		PrintLine(s)
+		writeLine(s)
 	}
 }
 
@@ -287,7 +545,7 @@ func joinMsg(m *Msg) {
 		} else {
 			s += m.content
 		}
-		PrintLine(s)
+		writeLine(s)
 	}
 }
 
@@ -295,20 +553,51 @@ func quitMsg(m *Msg) {
 	if !*ircClean {
 		s := "[" + m.timestamp + "]"
 		s += " " + m.nick + " [" + m.user + "@" + m.host + "]" + " has quit [" + m.content + "]"
-		PrintLine(s)
+		writeLine(s)
 	}
 }
 
-func updateTerm() {
+// runs on the event loop, the renderer picks it up in updateTerm
+func updatePrompt() {
 	var colour string
-	if strings.HasPrefix(curRcpt, "#") {
+	if _, ok := grpChans[strings.ToLower(curRcpt)]; ok {
+		colour = "Blue"
+	} else if strings.HasPrefix(curRcpt, "#") {
 		colour = "Yellow"
-	} else if OtrIsEncrypted(curRcpt) {
-		colour = "Green"
+	} else if backendFor(curRcpt).IsEncrypted(curRcpt) {
+		// encrypted, but to whom? unverified is cyan, changed or revoked magenta
+		switch backendFor(curRcpt).Trust(curRcpt) {
+		case TrustSmp, TrustManual:
+			colour = "Green"
+		case TrustRevoked:
+			colour = "Magenta"
+		default:
+			colour = "Cyan"
+		}
 	} else {
 		colour = "Red"
 	}
-	t.SetPrompt(ansiColour(colour, curRcpt) + promptEnd)
+	p := ansiColour(colour, curRcpt)
+	if sess, ok := OTR.conv[strings.ToLower(curRcpt)]; ok && sess.smp != smpIdle {
+		p += ansiColour("Yellow", "(smp)")
+	}
+	if n := backendFor(curRcpt).Pending(curRcpt); n > 0 {
+		p += ansiColour("Yellow", "("+strconv.Itoa(n)+" pending)")
+	}
+	promptLock.Lock()
+	changed := p != prompt
+	prompt = p
+	promptLock.Unlock()
+	if changed {
+		inbox.poke()
+	}
+}
+
+func updateTerm() {
+	promptLock.Lock()
+	p := prompt
+	promptLock.Unlock()
+	t.SetPrompt(p + promptEnd)
 	cw, ch, e := terminal.GetSize(0)
 	if e != nil {
 		PrintError(e)
@@ -319,10 +608,13 @@ func updateTerm() {
 	t.SetSize(tw, th)
 }
 
+func writeLine(line string) {
+	t.Write([]byte(line + "\r\n"))
+}
+
 func PrintLine(line string) {
 	if t != nil {
-		t.Write([]byte(line + "\r\n"))
-		updateTerm()
+		inbox.push(uiEvent{line: line})
 	} else {
 		fmt.Fprintln(os.Stdout, line)
 	}
@@ -333,6 +625,22 @@ func PrintError(e error) {
 	PrintLine(line)
 }
 
+func render(ev uiEvent) {
+	m := ev.m
+	if m == nil {
+		writeLine(ev.line)
+	} else if f, ok := printMap[m.cmd]; ok {
+		f(m)
+	} else if strings.HasPrefix(m.cmd, "4") || strings.HasPrefix(m.cmd, "5") {
+		errorMsg(m)
+	} else if strings.HasPrefix(m.cmd, "2") || strings.HasPrefix(m.cmd, "3") {
+		noticeMsg(m)
+	}
+	if ev.repeat > 0 {
+		writeLine(ansiColour("Magenta", fmt.Sprintf("*** %d more like that ***", ev.repeat)))
+	}
+}
+
 func InitTty() {
 	state, e := terminal.MakeRaw(0)
 	if e != nil {
@@ -342,35 +650,53 @@ func InitTty() {
 	defer terminal.Restore(0, state)
 	t = terminal.NewTerminal(os.Stdin, promptEnd)
 	setEscapeCodes()
+	go eventLoop()
+	defer stopLoop()
 	go func() {
-		for {
-			m := <-out
-			if f, ok := printMap[m.cmd]; ok {
-				f(m)
-			} else if strings.HasPrefix(m.cmd, "4") || strings.HasPrefix(m.cmd, "5") {
-				errorMsg(m)
-			} else if strings.HasPrefix(m.cmd, "2") || strings.HasPrefix(m.cmd, "3") {
-				noticeMsg(m)
+		for range inbox.wake {
+			events, dropped := inbox.drain()
+			if dropped > 0 {
+				writeLine(ansiColour("Magenta", fmt.Sprintf("*** %d lines dropped, terminal can't keep up ***", dropped)))
 			}
+			for _, ev := range events {
+				render(ev)
+			}
+			updateTerm()
 		}
 	}()
 	for {
 		s, e := t.ReadLine()
 		if e != nil {
-			PrintError(e)
-			Quit("Leaving.")
+			post(func() {
+				PrintError(e)
+				Quit("Leaving.")
+			})
 			return
 		}
-		if strings.HasPrefix(s, "/") {
-			s = s[1:]
-			cmd, args := split(s, " ")
-			if f, ok := inputMap[cmd]; ok {
-				f(args)
-			} else {
-				PrintLine("Unknown command '" + cmd + "'. Try /help.")
+		if strings.TrimSpace(s) == "/otr-unlock" {
+			// only this goroutine may read the terminal
+			pass, e := t.ReadPassword("Passphrase: ")
+			if e != nil {
+				PrintError(e)
+				continue
 			}
+			post(func() { OtrUnlock([]byte(pass)) })
+			continue
+		}
+		post(func() { handleInput(s) })
+	}
+}
+
+func handleInput(s string) {
+	if strings.HasPrefix(s, "/") {
+		s = s[1:]
+		cmd, args := split(s, " ")
+		if f, ok := inputMap[cmd]; ok {
+			f(args)
 		} else {
-			SendTo(curRcpt, s)
+			PrintLine("Unknown command '" + cmd + "'. Try /help.")
 		}
+	} else {
+		SendTo(curRcpt, s)
 	}
 }
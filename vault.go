@@ -0,0 +1,173 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// passphrases for the persistent key and for the contact store (and event
+// journal), kept so they can be resealed without asking again. they may be
+// the same. /otr-lock wipes the store's.
+var (
+	keyPass   []byte
+	storePass []byte
+)
+
+// on disk: magic || scrypt salt || secretbox nonce || secretbox(plaintext)
+var vaultMagic = []byte("irc-vault-1\n")
+
+const (
+	vaultSaltSize  = 32
+	vaultNonceSize = 24
+)
+
+func vaultKey(pass, salt []byte) (*[32]byte, error) {
+	k, e := scrypt.Key(pass, salt, 1<<16, 8, 1, 32)
+	if e != nil {
+		return nil, e
+	}
+	key := new([32]byte)
+	copy(key[:], k)
+	wipe(k)
+	return key, nil
+}
+
+func IsVault(d []byte) bool {
+	return bytes.HasPrefix(d, vaultMagic)
+}
+
+func VaultSeal(pass, plain []byte) ([]byte, error) {
+	salt := make([]byte, vaultSaltSize)
+	var nonce [vaultNonceSize]byte
+	if _, e := io.ReadFull(rand.Reader, salt); e != nil {
+		return nil, e
+	}
+	if _, e := io.ReadFull(rand.Reader, nonce[:]); e != nil {
+		return nil, e
+	}
+	key, e := vaultKey(pass, salt)
+	if e != nil {
+		return nil, e
+	}
+	defer wipe(key[:])
+	out := append([]byte{}, vaultMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, plain, &nonce, key), nil
+}
+
+func VaultOpen(pass, sealed []byte) ([]byte, error) {
+	if !IsVault(sealed) || len(sealed) < len(vaultMagic)+vaultSaltSize+vaultNonceSize+secretbox.Overhead {
+		return nil, errors.New("not an encrypted file")
+	}
+	sealed = sealed[len(vaultMagic):]
+	salt := sealed[:vaultSaltSize]
+	var nonce [vaultNonceSize]byte
+	copy(nonce[:], sealed[vaultSaltSize:])
+	key, e := vaultKey(pass, salt)
+	if e != nil {
+		return nil, e
+	}
+	defer wipe(key[:])
+	plain, ok := secretbox.Open(nil, sealed[vaultSaltSize+vaultNonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("wrong passphrase or corrupted file")
+	}
+	return plain, nil
+}
+
+// write to a temporary file first so a crash never leaves half a vault
+func writeFileAtomic(name string, d []byte) error {
+	tmp := name + ".tmp"
+	if e := writeFileSync(tmp, d); e != nil {
+		return e
+	}
+	return os.Rename(tmp, name)
+}
+
+// on the disk, not just in the page cache, before anything old is removed
+func writeFileSync(name string, d []byte) error {
+	f, e := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if e != nil {
+		return e
+	}
+	if _, e := f.Write(d); e != nil {
+		f.Close()
+		return e
+	}
+	if e := f.Sync(); e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// overwrite before unlinking, for what it's worth on modern disks
+func shredFile(name string) error {
+	fi, e := os.Stat(name)
+	if e != nil {
+		return e
+	}
+	junk := make([]byte, fi.Size())
+	io.ReadFull(rand.Reader, junk)
+	if e := ioutil.WriteFile(name, junk, 0600); e != nil {
+		return e
+	}
+	return os.Remove(name)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// only before the tty takes over stdin
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fmt.Fprint(os.Stdout, prompt)
+	pass, e := terminal.ReadPassword(0)
+	fmt.Fprintln(os.Stdout)
+	if e != nil {
+		return nil, e
+	}
+	if len(pass) < 1 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stdout, "Again: ")
+		again, e := terminal.ReadPassword(0)
+		fmt.Fprintln(os.Stdout)
+		if e != nil {
+			return nil, e
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return pass, nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVaultRoundTrip(t *testing.T) {
+	plain := []byte(`{"Contacts":{}}`)
+	sealed, e := VaultSeal([]byte("correct horse"), plain)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !IsVault(sealed) || bytes.Contains(sealed, plain) {
+		t.Fatal("sealed vault is unmarked or shows the plaintext")
+	}
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)-1] ^= 1
+	tests := []struct {
+		name   string
+		pass   string
+		sealed []byte
+		ok     bool
+	}{
+		{"right passphrase", "correct horse", sealed, true},
+		{"wrong passphrase", "correct horsf", sealed, false},
+		{"flipped bit", "correct horse", flipped, false},
+		{"truncated", "correct horse", sealed[:len(vaultMagic)+vaultSaltSize+vaultNonceSize], false},
+		{"plaintext", "correct horse", plain, false},
+	}
+	for _, tt := range tests {
+		got, e := VaultOpen([]byte(tt.pass), tt.sealed)
+		if (e == nil) != tt.ok || (tt.ok && !bytes.Equal(got, plain)) {
+			t.Errorf("%s: got %q, %v", tt.name, got, e)
+		}
+	}
+	again, _ := VaultSeal([]byte("correct horse"), plain)
+	if bytes.Equal(again, sealed) {
+		t.Error("sealing twice gave the same bytes, salt and nonce should be fresh")
+	}
+}
+
+func TestVaultFiles(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "store")
+	if e := writeFileAtomic(name, []byte("one")); e != nil {
+		t.Fatal(e)
+	}
+	if e := writeFileAtomic(name, []byte("two")); e != nil {
+		t.Fatal(e)
+	}
+	if d, _ := os.ReadFile(name); string(d) != "two" {
+		t.Errorf("got %q", d)
+	}
+	if _, e := os.Stat(name + ".tmp"); !os.IsNotExist(e) {
+		t.Error("left the .tmp behind")
+	}
+	if fi, _ := os.Stat(name); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", fi.Mode())
+	}
+	if e := shredFile(name); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := os.Stat(name); !os.IsNotExist(e) {
+		t.Error("shredded file still there")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright (C) 2016 cacahuatl < cacahuatl at autistici dot org >
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+// pictures of a fingerprint for comparing by eye, made from the same hash
+// fingerprint() prints: OpenSSH's drunken bishop randomart and a row of
+// coloured blocks
+
+const (
+	artWidth  = 17
+	artHeight = 9
+	artChars  = " .o+=*BOX@%&#/^SE"
+)
+
+func randomart(d []byte, top, bottom string) []string {
+	var field [artWidth][artHeight]int
+	x, y := artWidth/2, artHeight/2
+	last := len(artChars) - 1
+	for _, b := range d {
+		for i := 0; i < 4; i++ {
+			if b&1 > 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 > 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clampInt(x, 0, artWidth-1)
+			y = clampInt(y, 0, artHeight-1)
+			if field[x][y] < last-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[artWidth/2][artHeight/2] = last - 1
+	field[x][y] = last
+	out := []string{artBorder(top)}
+	for j := 0; j < artHeight; j++ {
+		row := "|"
+		for i := 0; i < artWidth; i++ {
+			row += string(artChars[field[i][j]])
+		}
+		out = append(out, row+"|")
+	}
+	return append(out, artBorder(bottom))
+}
+
+func artBorder(title string) string {
+	title = "[" + title + "]"
+	if len(title) > artWidth {
+		title = title[:artWidth]
+	}
+	left := (artWidth - len(title)) / 2
+	return "+" + strings.Repeat("-", left) + title + strings.Repeat("-", artWidth-left-len(title)) + "+"
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+var blockColours = []string{"Black", "Red", "Green", "Yellow", "Blue", "Magenta", "Cyan", "White"}
+
+// three bits a block, black ones drawn shaded so they show on dark terminals
+const colourBlockCount = 16
+
+func colourBlocks(d []byte) string {
+	var s string
+	for k := 0; k < colourBlockCount; k++ {
+		bit := k * 3
+		if bit/8+1 >= len(d) {
+			break
+		}
+		v := (int(d[bit/8])<<8 | int(d[bit/8+1])) >> uint(13-bit%8) & 7
+		if v == 0 {
+			s += ansiColour("White", "░")
+		} else {
+			s += ansiColour(blockColours[v], "█")
+		}
+	}
+	return s
+}
+
+// the randomart box with the colour blocks underneath, as fingerprint() hashes
+func fingerprintArt(d []byte, prehashed bool, top string) []string {
+	bottom := "SHA1"
+	if !prehashed {
+		h := sha256.Sum256(d)
+		d = h[:]
+		bottom = "SHA256"
+	}
+	art := randomart(d, top, bottom)
+	return append(art, "  "+colourBlocks(d)+" ") // as wide as the box
+}
+
+// boxes next to each other, e.g. the stored and the new key on a key change
+func PrintArt(prefix string, arts ...[]string) {
+	if !*fpArt {
+		return
+	}
+	for j := range arts[0] {
+		var row []string
+		for _, a := range arts {
+			row = append(row, a[j])
+		}
+		PrintLine(prefix + strings.Join(row, "   "))
+	}
+}